@@ -0,0 +1,76 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+// QueryModel holds the DuckDB specific options of a query. The common SQL options (rawSql, format,
+// fillMode, ...) are read by sqlutil.GetQuery.
+type QueryModel struct {
+	Incremental bool `json:"incremental"`
+	// Explain runs the query under EXPLAIN (ExplainModePlan) or EXPLAIN ANALYZE (ExplainModeAnalyze)
+	// and returns the plan instead of the result.
+	Explain string `json:"explain"`
+	// LogContext turns the query into a log context query, returning the log lines around the one
+	// at LogContext.Time.
+	LogContext *LogContext `json:"logContext"`
+	// Columns maps the fields of the node graph, flame graph and heatmap formats to the columns of
+	// the result they are read from, when the columns are not named like the fields.
+	Columns map[string]string `json:"columns,omitempty"`
+	// LabelColumns and ValueColumns select the columns a time series result is split into series
+	// by, and the columns of the series values. By default every text column is a label and every
+	// other column a value.
+	LabelColumns []string `json:"labelColumns,omitempty"`
+	ValueColumns []string `json:"valueColumns,omitempty"`
+	// LegendFormat names the series of a time series result, like {{host}} {{region}}.
+	LegendFormat string `json:"legendFormat,omitempty"`
+	// Stream pushes the rows appended after the query ran to the panel over Grafana Live.
+	Stream *Stream `json:"stream,omitempty"`
+}
+
+// Stream follows the rows of a query past the largest value of Column, a time or sequence column,
+// polling the query every Interval. With Files set, it follows the files matching the glob
+// instead, reading each new file once with the query.
+type Stream struct {
+	Column   string `json:"column,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Files    string `json:"files,omitempty"`
+}
+
+// LogContext selects the log lines before (LogContextBackward) or after (LogContextForward) the
+// log line at Time, in milliseconds since the epoch.
+type LogContext struct {
+	Time      int64  `json:"time"`
+	Direction string `json:"direction"`
+	Limit     int    `json:"limit"`
+}
+
+// Query formats of the plugin. They are numbered from 100, apart from the ones sqlutil defines
+// from 0, so that the formats sqlutil adds do not collide with them. The numbers are saved in the
+// query JSON of dashboards and must not change.
+const (
+	FormatOptionNodeGraph  sqlutil.FormatQueryOption = 100
+	FormatOptionFlameGraph sqlutil.FormatQueryOption = 101
+	FormatOptionHeatmap    sqlutil.FormatQueryOption = 102
+)
+
+const (
+	ExplainModePlan    = "explain"
+	ExplainModeAnalyze = "analyze"
+
+	LogContextBackward = "backward"
+	LogContextForward  = "forward"
+)
+
+func LoadQueryModel(query backend.DataQuery) (*QueryModel, error) {
+	model := QueryModel{}
+	err := json.Unmarshal(query.JSON, &model)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal QueryModel json: %w", err)
+	}
+	return &model, nil
+}
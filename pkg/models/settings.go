@@ -11,7 +11,50 @@ type PluginSettings struct {
 	Path         string                `json:"path"`
 	InitSql      string                `json:"initSql"`
 	MaxOpenConns int                   `json:"maxOpenConns"`
+	QueryTimeout int                   `json:"queryTimeout"`
+	Profiling    bool                  `json:"profiling"`
+	ReadOnly     bool                  `json:"readOnly"`
 	Secrets      *SecretPluginSettings `json:"-"`
+
+	// Result cache. CacheTTL and CacheTimeStep are in seconds, CacheMaxSize in MB.
+	CacheTTL      int `json:"cacheTTL"`
+	CacheTimeStep int `json:"cacheTimeStep"`
+	CacheMaxSize  int `json:"cacheMaxSize"`
+
+	// Admission control. MaxQueueWait is in seconds.
+	MaxConcurrentQueries int `json:"maxConcurrentQueries"`
+	MaxQueueLength       int `json:"maxQueueLength"`
+	MaxQueueWait         int `json:"maxQueueWait"`
+	AlertingWeight       int `json:"alertingWeight"`
+	DashboardWeight      int `json:"dashboardWeight"`
+
+	// Resource limits, applied when the database is opened. MemoryLimit and MaxTempDirectorySize
+	// use DuckDB's size syntax, e.g. "4GB". MemoryWatermark is a percentage of the memory limit.
+	MemoryLimit          string `json:"memoryLimit"`
+	Threads              int    `json:"threads"`
+	TempDirectory        string `json:"tempDirectory"`
+	MaxTempDirectorySize string `json:"maxTempDirectorySize"`
+	MemoryWatermark      int    `json:"memoryWatermark"`
+
+	// Sandbox, applied after the boot queries and InitSql. Queries may only read files in
+	// AllowedDirectories (directories or URL prefixes).
+	Sandbox            bool     `json:"sandbox"`
+	AllowedDirectories []string `json:"allowedDirectories"`
+
+	// Query policy. Statement types are named by their leading keyword (SELECT, COPY, ...), an
+	// empty allow list allows everything that is not denied. Users with one of PolicyExemptRoles
+	// (e.g. "Admin") are not restricted.
+	AllowedStatements     []string `json:"allowedStatements"`
+	DeniedStatements      []string `json:"deniedStatements"`
+	AllowedTableFunctions []string `json:"allowedTableFunctions"`
+	DeniedTableFunctions  []string `json:"deniedTableFunctions"`
+	AllowedFunctions      []string `json:"allowedFunctions"`
+	DeniedFunctions       []string `json:"deniedFunctions"`
+	PolicyExemptRoles     []string `json:"policyExemptRoles"`
+
+	// Live streams. StreamCursorDirectory holds the files file streams record the files they have
+	// read in, so a restart does not replay them.
+	StreamCursorDirectory string `json:"streamCursorDirectory"`
 }
 
 type SecretPluginSettings struct {
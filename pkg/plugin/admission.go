@@ -0,0 +1,263 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v3"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultAlertingWeight  = 3
+	defaultDashboardWeight = 1
+	defaultMaxQueueLength  = 100
+	defaultMaxQueueWait    = 10 * time.Second
+)
+
+var (
+	// ErrorQueueFull is returned when a query is rejected because too many queries are waiting to run.
+	ErrorQueueFull = errors.New("query queue is full")
+	// ErrorQueueTimeout is returned when a query waited too long for its turn to run.
+	ErrorQueueTimeout = errors.New("timed out waiting in the query queue")
+)
+
+var (
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "plugins",
+		Name:      "duckdb_query_queue_depth",
+		Help:      "Number of queries waiting for a free query slot",
+	}, []string{"datasource_name", "datasource_type", "class"})
+	queueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "plugins",
+		Name:      "duckdb_query_queue_wait_seconds",
+		Help:      "Time queries waited for a free query slot",
+	}, []string{"datasource_name", "datasource_type", "class"})
+	queueRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "plugins",
+		Name:      "duckdb_query_queue_rejected_total",
+		Help:      "Number of queries rejected because the queue was full or the wait timed out",
+	}, []string{"datasource_name", "datasource_type", "class", "reason"})
+)
+
+// trafficClass tells alert rule evaluations apart from dashboard and Explore queries, so that
+// alerting keeps getting query slots while dashboards are busy.
+type trafficClass int
+
+const (
+	classDashboard trafficClass = iota
+	classAlerting
+	numTrafficClasses
+)
+
+func (c trafficClass) String() string {
+	if c == classAlerting {
+		return "alerting"
+	}
+	return "dashboard"
+}
+
+type trafficClassKey struct{}
+
+// classifyRequest detects alert and recording rule evaluations by the headers Grafana sets on
+// them: FromAlert, and the X-Rule-Uid, X-Rule-Name, ... headers identifying the rule. Forwarded
+// HTTP headers carry an http_ prefix, and header names are matched regardless of case.
+func classifyRequest(ctx context.Context, req *backend.QueryDataRequest) context.Context {
+	class := classDashboard
+	for name, value := range req.Headers {
+		name = strings.TrimPrefix(strings.ToLower(name), "http_")
+		switch {
+		case name == "fromalert" && strings.EqualFold(value, "true"):
+			class = classAlerting
+		case strings.HasPrefix(name, "x-rule-") && value != "":
+			class = classAlerting
+		}
+	}
+	return context.WithValue(ctx, trafficClassKey{}, class)
+}
+
+func trafficClassFromContext(ctx context.Context) trafficClass {
+	if class, ok := ctx.Value(trafficClassKey{}).(trafficClass); ok {
+		return class
+	}
+	return classDashboard
+}
+
+// admissionController limits the number of queries running in DuckDB at once. Queries beyond the
+// limit wait in a queue per traffic class. Free slots are handed out across the queues by weight,
+// with stride scheduling: the non-empty queue that has been served least relative to its weight
+// goes next, so neither class can starve the other.
+type admissionController struct {
+	mu       sync.Mutex
+	slots    int
+	running  int
+	maxQueue int
+	maxWait  time.Duration
+	weights  [numTrafficClasses]int
+	pass     [numTrafficClasses]float64
+	queues   [numTrafficClasses][]*admissionTicket
+	metrics  sqlds.Metrics
+}
+
+type admissionTicket struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// newAdmissionController returns the admission controller configured in config, or nil when the
+// number of concurrent queries is not limited.
+func newAdmissionController(config *models.PluginSettings, metrics sqlds.Metrics) *admissionController {
+	if config.MaxConcurrentQueries <= 0 {
+		return nil
+	}
+	a := &admissionController{
+		slots:    config.MaxConcurrentQueries,
+		maxQueue: defaultMaxQueueLength,
+		maxWait:  defaultMaxQueueWait,
+		weights:  [numTrafficClasses]int{defaultDashboardWeight, defaultAlertingWeight},
+		metrics:  metrics,
+	}
+	if config.MaxQueueLength > 0 {
+		a.maxQueue = config.MaxQueueLength
+	}
+	if config.MaxQueueWait > 0 {
+		a.maxWait = time.Duration(config.MaxQueueWait) * time.Second
+	}
+	if config.DashboardWeight > 0 {
+		a.weights[classDashboard] = config.DashboardWeight
+	}
+	if config.AlertingWeight > 0 {
+		a.weights[classAlerting] = config.AlertingWeight
+	}
+	return a
+}
+
+// Acquire waits for a free query slot. The returned release func must be called once the query
+// has finished.
+func (a *admissionController) Acquire(ctx context.Context, class trafficClass) (release func(), err error) {
+	start := time.Now()
+
+	a.mu.Lock()
+	if a.running < a.slots && a.waiting() == 0 {
+		a.running++
+		a.mu.Unlock()
+		a.observeWait(class, start)
+		return a.release, nil
+	}
+	if len(a.queues[class]) >= a.maxQueue {
+		a.mu.Unlock()
+		queueRejected.WithLabelValues(a.metrics.DSName, a.metrics.DSType, class.String(), "full").Inc()
+		return nil, sqlds.DownstreamError(fmt.Errorf("%w: %d %s queries are already waiting for one of %d query slots", ErrorQueueFull, a.maxQueue, class, a.slots))
+	}
+	if len(a.queues[class]) == 0 {
+		// A queue that was idle must not catch up on the turns it did not need.
+		if minPass, ok := a.minPass(); ok {
+			a.pass[class] = max(a.pass[class], minPass)
+		}
+	}
+	ticket := &admissionTicket{ready: make(chan struct{})}
+	a.queues[class] = append(a.queues[class], ticket)
+	queueDepth.WithLabelValues(a.metrics.DSName, a.metrics.DSType, class.String()).Inc()
+	a.mu.Unlock()
+
+	timer := time.NewTimer(a.maxWait)
+	defer timer.Stop()
+
+	select {
+	case <-ticket.ready:
+		a.observeWait(class, start)
+		return a.release, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		queueRejected.WithLabelValues(a.metrics.DSName, a.metrics.DSType, class.String(), "timeout").Inc()
+		err = fmt.Errorf("%w: no query slot became free within %s", ErrorQueueTimeout, a.maxWait)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ticket.granted {
+		// The slot was handed over while giving up, pass it on.
+		a.running--
+		a.dispatch()
+	} else {
+		a.dequeue(class, ticket)
+	}
+	return nil, sqlds.DownstreamError(err)
+}
+
+func (a *admissionController) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.running--
+	a.dispatch()
+}
+
+// dispatch hands free slots to waiting queries. a.mu must be held.
+func (a *admissionController) dispatch() {
+	for a.running < a.slots {
+		class, ok := a.next()
+		if !ok {
+			return
+		}
+		ticket := a.queues[class][0]
+		a.queues[class] = a.queues[class][1:]
+		queueDepth.WithLabelValues(a.metrics.DSName, a.metrics.DSType, class.String()).Dec()
+		a.pass[class] += 1 / float64(a.weights[class])
+
+		a.running++
+		ticket.granted = true
+		close(ticket.ready)
+	}
+}
+
+// next returns the non-empty queue with the lowest pass. a.mu must be held.
+func (a *admissionController) next() (trafficClass, bool) {
+	found := false
+	var next trafficClass
+	for class := trafficClass(0); class < numTrafficClasses; class++ {
+		if len(a.queues[class]) == 0 {
+			continue
+		}
+		if !found || a.pass[class] < a.pass[next] {
+			next, found = class, true
+		}
+	}
+	return next, found
+}
+
+// minPass returns the lowest pass of the non-empty queues. a.mu must be held.
+func (a *admissionController) minPass() (float64, bool) {
+	class, ok := a.next()
+	return a.pass[class], ok
+}
+
+func (a *admissionController) waiting() int {
+	n := 0
+	for _, queue := range a.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+func (a *admissionController) dequeue(class trafficClass, ticket *admissionTicket) {
+	for i, t := range a.queues[class] {
+		if t == ticket {
+			a.queues[class] = append(a.queues[class][:i], a.queues[class][i+1:]...)
+			queueDepth.WithLabelValues(a.metrics.DSName, a.metrics.DSType, class.String()).Dec()
+			return
+		}
+	}
+}
+
+func (a *admissionController) observeWait(class trafficClass, start time.Time) {
+	queueWait.WithLabelValues(a.metrics.DSName, a.metrics.DSType, class.String()).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v3"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+func TestClassifyRequest(t *testing.T) {
+	for _, headers := range []map[string]string{
+		{"FromAlert": "true"},
+		{"fromalert": "TRUE"},
+		{"http_FromAlert": "true"},
+		{"http_X-Rule-Uid": "abc123"},
+		{"X-Rule-Uid": "abc123"},
+		{"http_x-rule-name": "Recording rule"},
+	} {
+		ctx := classifyRequest(context.Background(), &backend.QueryDataRequest{Headers: headers})
+		if trafficClassFromContext(ctx) != classAlerting {
+			t.Errorf("expected rule evaluations with headers %v to be classified as alerting", headers)
+		}
+	}
+	for _, headers := range []map[string]string{
+		nil,
+		{"FromAlert": "false"},
+		{"http_X-Dashboard-Uid": "abc123"},
+	} {
+		ctx := classifyRequest(context.Background(), &backend.QueryDataRequest{Headers: headers})
+		if trafficClassFromContext(ctx) != classDashboard {
+			t.Errorf("expected requests with headers %v to be classified as dashboard", headers)
+		}
+	}
+}
+
+func TestAdmissionWeights(t *testing.T) {
+	a := newAdmissionController(&models.PluginSettings{MaxConcurrentQueries: 1, AlertingWeight: 3, DashboardWeight: 1}, sqlds.Metrics{})
+
+	release, err := a.Acquire(context.Background(), classDashboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		order []trafficClass
+		wg    sync.WaitGroup
+	)
+	enqueue := func(class trafficClass) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := a.Acquire(context.Background(), class)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, class)
+			mu.Unlock()
+			release()
+		}()
+		// Keep the queues in a predictable order.
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		enqueue(classDashboard)
+	}
+	for i := 0; i < 4; i++ {
+		enqueue(classAlerting)
+	}
+
+	release()
+	wg.Wait()
+
+	alerting := 0
+	for _, class := range order[:4] {
+		if class == classAlerting {
+			alerting++
+		}
+	}
+	if alerting != 3 {
+		t.Errorf("expected 3 of the first 4 slots to go to alerting, got order %v", order)
+	}
+}
+
+func TestAdmissionQueueLimits(t *testing.T) {
+	a := newAdmissionController(&models.PluginSettings{MaxConcurrentQueries: 1, MaxQueueLength: 1, MaxQueueWait: 1}, sqlds.Metrics{})
+
+	release, err := a.Acquire(context.Background(), classDashboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	waiting := make(chan error)
+	go func() {
+		_, err := a.Acquire(context.Background(), classDashboard)
+		waiting <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := a.Acquire(context.Background(), classDashboard); !errors.Is(err, ErrorQueueFull) {
+		t.Errorf("expected the queue to be full, got %v", err)
+	}
+	if err := <-waiting; !errors.Is(err, ErrorQueueTimeout) {
+		t.Errorf("expected the wait to time out, got %v", err)
+	}
+	if a.waiting() != 0 {
+		t.Errorf("expected abandoned tickets to leave the queue, %d still waiting", a.waiting())
+	}
+}
+
+// expectSlotWait holds the only query slot of ds and checks that call does not finish before the
+// slot is released.
+func expectSlotWait(t *testing.T, ds *SQLDataSourceWrapper, call func()) {
+	t.Helper()
+	release, err := ds.admission.Acquire(context.Background(), classDashboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		call()
+	}()
+	select {
+	case <-done:
+		release()
+		t.Fatal("expected the query to wait for a free slot")
+	case <-time.After(200 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the query to run once the slot is released")
+	}
+}
@@ -0,0 +1,203 @@
+package plugin
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+const (
+	// defaultCacheTimeStep is used when the result cache is enabled without a time step.
+	defaultCacheTimeStep = time.Minute
+	// defaultCacheMaxSize is used when the result cache is enabled without a memory bound, in MB.
+	defaultCacheMaxSize = 64
+	// incrementalCacheTTL is how long the rows of an incremental query are kept after its last run.
+	incrementalCacheTTL = 15 * time.Minute
+)
+
+// resultCache keeps the frames of recent query results in memory. Frames are stored serialized
+// as arrow, so cached results can never be modified by a caller and their size is known exactly.
+// Entries expire after ttl, and the least recently used entries are evicted once the cache holds
+// more than maxBytes.
+type resultCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	step     time.Duration
+	maxBytes int
+	size     int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+type cacheEntry struct {
+	key     string
+	frames  [][]byte
+	span    backend.TimeRange
+	size    int
+	expires time.Time
+}
+
+// newResultCache returns the result cache configured in config, or nil when caching is disabled.
+func newResultCache(config *models.PluginSettings) *resultCache {
+	if config.CacheTTL <= 0 {
+		return nil
+	}
+	step := defaultCacheTimeStep
+	if config.CacheTimeStep > 0 {
+		step = time.Duration(config.CacheTimeStep) * time.Second
+	}
+	return &resultCache{
+		ttl:      time.Duration(config.CacheTTL) * time.Second,
+		step:     step,
+		maxBytes: cacheMaxBytes(config),
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// newIncrementalCache returns the cache holding the rows fetched by incremental queries. It is
+// always available, as incremental caching is enabled per query, and splits the memory bound with
+// the result cache when that is enabled too.
+func newIncrementalCache(config *models.PluginSettings) *resultCache {
+	return &resultCache{
+		ttl:      incrementalCacheTTL,
+		maxBytes: cacheMaxBytes(config),
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// cacheMaxBytes returns the memory bound of each cache. The configured bound covers both the result
+// and the incremental cache, each gets half of it when both are in use.
+func cacheMaxBytes(config *models.PluginSettings) int {
+	maxSize := defaultCacheMaxSize
+	if config.CacheMaxSize > 0 {
+		maxSize = config.CacheMaxSize
+	}
+	maxBytes := maxSize * 1024 * 1024
+	if config.CacheTTL > 0 {
+		maxBytes /= 2
+	}
+	return maxBytes
+}
+
+// roundTimeRange truncates both ends of the time range to the cache time step, so that refreshes
+// of a relative time range ("last 6 hours") expand to the same SQL until the next step begins.
+func (c *resultCache) roundTimeRange(tr backend.TimeRange) backend.TimeRange {
+	return backend.TimeRange{
+		From: tr.From.Truncate(c.step),
+		To:   tr.To.Truncate(c.step),
+	}
+}
+
+// resultCacheKey identifies the result of a query with macros already expanded, run with args.
+func resultCacheKey(datasourceUID string, q *sqlutil.Query, model *models.QueryModel, args ...any) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00%d\x00", datasourceUID, q.RefID, q.Format, q.TimeRange.From.UnixNano(), q.TimeRange.To.UnixNano())
+	if q.FillMissing != nil {
+		fmt.Fprintf(h, "%d\x00%v\x00", q.FillMissing.Mode, q.FillMissing.Value)
+	}
+	options, _ := json.Marshal(model)
+	h.Write(options)
+	h.Write([]byte(q.RawSQL))
+	if len(args) > 0 {
+		fmt.Fprintf(h, "\x00%#v", args)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the cached frames for key, if there are any that have not expired yet.
+func (c *resultCache) Get(key string) (data.Frames, bool) {
+	frames, _, ok := c.GetSpan(key)
+	return frames, ok
+}
+
+// GetSpan returns the cached frames for key along with the time range they cover.
+func (c *resultCache) GetSpan(key string) (data.Frames, backend.TimeRange, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, backend.TimeRange{}, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil, backend.TimeRange{}, false
+	}
+	c.lru.MoveToFront(elem)
+
+	frames, err := data.UnmarshalArrowFrames(entry.frames)
+	if err != nil {
+		backend.Logger.Warn("Could not read cached query result", "error", err)
+		c.remove(elem)
+		return nil, backend.TimeRange{}, false
+	}
+	return frames, entry.span, true
+}
+
+// Set caches frames under key. Results larger than the whole cache are not cached.
+func (c *resultCache) Set(key string, frames data.Frames) {
+	c.SetSpan(key, frames, backend.TimeRange{})
+}
+
+// SetSpan caches frames under key, recording the time range they cover.
+func (c *resultCache) SetSpan(key string, frames data.Frames, span backend.TimeRange) {
+	encoded, err := frames.MarshalArrow()
+	if err != nil {
+		backend.Logger.Warn("Could not cache query result", "error", err)
+		return
+	}
+	size := len(key)
+	for _, b := range encoded {
+		size += len(b)
+	}
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:     key,
+		frames:  encoded,
+		span:    span,
+		size:    size,
+		expires: time.Now().Add(c.ttl),
+	})
+	c.size += size
+
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Purge drops every cached result, e.g. because the database file has changed.
+func (c *resultCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.size = 0
+}
+
+func (c *resultCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
@@ -0,0 +1,185 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+func TestResultCacheExpiry(t *testing.T) {
+	c := newResultCache(&models.PluginSettings{CacheTTL: 1})
+	c.ttl = 50 * time.Millisecond
+
+	c.Set("a", data.Frames{data.NewFrame("A", data.NewField("v", nil, []int64{1}))})
+	frames, ok := c.Get("a")
+	if !ok || frames[0].Name != "A" {
+		t.Fatal("expected a cache hit")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected the entry to expire")
+	}
+	if c.size != 0 || c.lru.Len() != 0 {
+		t.Errorf("expected expired entry to be removed, size %d with %d entries", c.size, c.lru.Len())
+	}
+}
+
+func TestCacheMemoryBound(t *testing.T) {
+	config := &models.PluginSettings{CacheMaxSize: 10}
+	if got := newIncrementalCache(config).maxBytes; got != 10*1024*1024 {
+		t.Errorf("expected the incremental cache alone to get the whole bound, got %d bytes", got)
+	}
+
+	config.CacheTTL = 60
+	total := newResultCache(config).maxBytes + newIncrementalCache(config).maxBytes
+	if total != 10*1024*1024 {
+		t.Errorf("expected both caches to share the bound, they get %d bytes together", total)
+	}
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	c := newResultCache(&models.PluginSettings{CacheTTL: 60})
+
+	frame := data.NewFrame("A", data.NewField("v", nil, make([]int64, 1024)))
+	encoded, err := frame.MarshalArrow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.maxBytes = 2*len(encoded) + 10
+
+	c.Set("a", data.Frames{frame})
+	c.Set("b", data.Frames{frame})
+	c.Get("a")
+	c.Set("c", data.Frames{frame})
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("expected %q to be cached", key)
+		}
+	}
+	if c.size > c.maxBytes {
+		t.Errorf("cache holds %d bytes, more than its bound of %d", c.size, c.maxBytes)
+	}
+
+	c.Purge()
+	if _, ok := c.Get("a"); ok || c.size != 0 {
+		t.Error("expected purge to drop every entry")
+	}
+}
+
+func TestQueryDataUsesResultCache(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "cacheTTL": 60}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	query := func(sql string) any {
+		t.Helper()
+		model, _ := json.Marshal(map[string]any{"rawSql": sql, "format": 1})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID:     "A",
+				JSON:      model,
+				TimeRange: backend.TimeRange{From: now.Add(-time.Hour), To: now},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Responses["A"].Error != nil {
+			t.Fatal(resp.Responses["A"].Error)
+		}
+		v, _ := resp.Responses["A"].Frames[0].Fields[0].ConcreteAt(0)
+		return v
+	}
+
+	first := query("SELECT random() AS r WHERE $__timeTo > $__timeFrom")
+	if second := query("SELECT random() AS r WHERE $__timeTo > $__timeFrom"); second != first {
+		t.Errorf("expected the cached result %v, got %v", first, second)
+	}
+
+	ds.cache.Purge()
+	if third := query("SELECT random() AS r WHERE $__timeTo > $__timeFrom"); third == first {
+		t.Error("expected the query to run again after the cache was purged")
+	}
+}
+
+func TestIncrementalQuery(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "initSql": "CREATE TABLE points AS SELECT TIMESTAMP '2024-01-01' + to_minutes(i) AS ts, 1 AS v FROM range(0, 120) t(i);"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := func(sql string, from, to time.Time) *data.Frame {
+		t.Helper()
+		model, _ := json.Marshal(map[string]any{"rawSql": sql, "format": 1, "incremental": strings.Contains(sql, "$__timeFilter")})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID:     "A",
+				JSON:      model,
+				Interval:  time.Minute,
+				TimeRange: backend.TimeRange{From: from, To: to},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Responses["A"].Error != nil {
+			t.Fatal(resp.Responses["A"].Error)
+		}
+		return resp.Responses["A"].Frames[0]
+	}
+	sql := "SELECT ts AS time, v FROM points WHERE $__timeFilter(ts) ORDER BY ts"
+
+	frame := query(sql, start, start.Add(30*time.Minute))
+	if frame.Rows() != 31 {
+		t.Fatalf("expected 31 rows, got %d", frame.Rows())
+	}
+
+	// Rows changed inside the cached range are not fetched again, rows in the tail are.
+	query("UPDATE points SET v = 2", start, start)
+	frame = query(sql, start.Add(10*time.Minute), start.Add(40*time.Minute))
+	if frame.Rows() != 31 {
+		t.Fatalf("expected 31 rows, got %d", frame.Rows())
+	}
+	for i := 0; i < frame.Rows(); i++ {
+		ts, _ := frame.Fields[0].ConcreteAt(i)
+		v, _ := frame.Fields[1].ConcreteAt(i)
+		want := int32(1)
+		if !ts.(time.Time).Before(start.Add(29 * time.Minute)) {
+			want = 2
+		}
+		if v != want {
+			t.Errorf("row at %s: expected %d, got %v", ts, want, v)
+		}
+	}
+
+	model, _ := json.Marshal(map[string]any{"rawSql": "SELECT ts AS time, v FROM points", "incremental": true})
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: model}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Responses["A"].Error == nil {
+		t.Error("expected incremental queries without time range macros to be rejected")
+	}
+}
@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// catalogDatabase is an attached database listed by the /catalog resource.
+type catalogDatabase struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Path     string   `json:"path,omitempty"`
+	ReadOnly bool     `json:"readOnly"`
+	Current  bool     `json:"current"`
+	Comment  string   `json:"comment,omitempty"`
+	Schemas  []string `json:"schemas"`
+}
+
+// handleCatalog lists the databases attached to DuckDB, by the connection string, InitSql or
+// queries, with their schemas. The internal system and temp databases are left out.
+func (d *SQLDataSourceWrapper) handleCatalog(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	databases := []*catalogDatabase{}
+	byName := map[string]*catalogDatabase{}
+	err := d.queryResource(ctx, `
+		SELECT database_name, type, path, readonly, database_name = current_database(), comment
+		FROM duckdb_databases()
+		WHERE NOT internal
+		ORDER BY database_name <> current_database(), database_name`, nil, func(rows *sql.Rows) error {
+		var (
+			database      catalogDatabase
+			path, comment sql.NullString
+		)
+		if err := rows.Scan(&database.Name, &database.Type, &path, &database.ReadOnly, &database.Current, &comment); err != nil {
+			return err
+		}
+		database.Path, database.Comment = path.String, comment.String
+		database.Schemas = []string{}
+		databases = append(databases, &database)
+		byName[database.Name] = &database
+		return nil
+	})
+	if err == nil {
+		err = d.queryResource(ctx, `
+			SELECT database_name, schema_name
+			FROM duckdb_schemas()
+			WHERE schema_name NOT IN ('information_schema', 'pg_catalog')
+			ORDER BY database_name, schema_name`, nil, func(rows *sql.Rows) error {
+			var databaseName, schemaName string
+			if err := rows.Scan(&databaseName, &schemaName); err != nil {
+				return err
+			}
+			if database, ok := byName[databaseName]; ok {
+				database.Schemas = append(database.Schemas, schemaName)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		sendResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	sendResource(rw, map[string]any{"databases": databases})
+}
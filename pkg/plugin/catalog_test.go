@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestCatalog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "archive.duckdb")
+	initSQL := "ATTACH '" + file + "' AS archive; CREATE SCHEMA archive.old; ATTACH ':memory:' AS scratch; DETACH archive; ATTACH '" + file + "' AS archive (READ_ONLY);"
+	settings, _ := json.Marshal(map[string]any{"path": "", "initSql": initSQL})
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := callResource(t, ds, "catalog", nil)
+	if resp.Status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Status, resp.Body)
+	}
+	var catalog struct {
+		Databases []catalogDatabase `json:"databases"`
+	}
+	if err := json.Unmarshal(resp.Body, &catalog); err != nil {
+		t.Fatal(err)
+	}
+	expected := []catalogDatabase{
+		{Name: "memory", Type: "duckdb", Current: true, Schemas: []string{"main"}},
+		{Name: "archive", Type: "duckdb", Path: file, ReadOnly: true, Schemas: []string{"main", "old"}},
+		{Name: "scratch", Type: "duckdb", Schemas: []string{"main"}},
+	}
+	if !reflect.DeepEqual(catalog.Databases, expected) {
+		t.Errorf("expected %+v, got %+v", expected, catalog.Databases)
+	}
+}
+
+func TestCatalogAdmission(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path": "", "maxConcurrentQueries": 1}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectSlotWait(t, ds, func() {
+		if resp := callResource(t, ds, "catalog", nil); resp.Status != http.StatusOK {
+			t.Errorf("expected status 200, got %d: %s", resp.Status, resp.Body)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/sqlds/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var coalescedQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "plugins",
+	Name:      "duckdb_coalesced_queries_total",
+	Help:      "Number of queries that shared the execution of an identical in-flight query",
+}, []string{"datasource_name", "datasource_type"})
+
+// coalescer lets concurrent callers with the same key share a single execution and its result.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+type inflightCall struct {
+	done    chan struct{}
+	frames  data.Frames
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: map[string]*inflightCall{}}
+}
+
+// Do runs fn once for all concurrent callers with the same key and returns its result to each of
+// them. shared reports whether the caller joined an execution started by another caller.
+//
+// A caller whose ctx is done stops waiting right away, but fn keeps running for the remaining
+// callers: it runs with a context that is only cancelled once every caller has gone. The last
+// caller to leave waits for fn to be interrupted, so that it returns once the query has stopped.
+func (c *coalescer) Do(ctx context.Context, key string, fn func(context.Context) (data.Frames, error)) (frames data.Frames, err error, shared bool) {
+	c.mu.Lock()
+	call, shared := c.calls[key]
+	if shared {
+		call.waiters++
+		c.mu.Unlock()
+	} else {
+		runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &inflightCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		c.calls[key] = call
+		c.mu.Unlock()
+
+		go func() {
+			defer cancel()
+			call.frames, call.err = fn(runCtx)
+			c.forget(key, call)
+			close(call.done)
+		}()
+	}
+
+	select {
+	case <-call.done:
+		return call.frames, call.err, shared
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	call.waiters--
+	last := call.waiters == 0
+	if last && c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	c.mu.Unlock()
+
+	if !last {
+		return nil, sqlds.DownstreamError(fmt.Errorf("%w: stopped waiting for the query", ctx.Err())), shared
+	}
+	call.cancel()
+	<-call.done
+	return call.frames, call.err, shared
+}
+
+// forget removes call from the in-flight calls, unless it has been replaced already.
+func (c *coalescer) forget(key string, call *inflightCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+}
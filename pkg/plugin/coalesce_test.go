@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestCoalescerSharesExecution(t *testing.T) {
+	c := newCoalescer()
+	release := make(chan struct{})
+	var runs atomic.Int32
+
+	fn := func(ctx context.Context) (data.Frames, error) {
+		runs.Add(1)
+		<-release
+		return data.Frames{data.NewFrame("A")}, nil
+	}
+
+	var (
+		wg     sync.WaitGroup
+		shared atomic.Int32
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			frames, err, s := c.Do(context.Background(), "key", fn)
+			if err != nil || len(frames) != 1 {
+				t.Errorf("unexpected result: %v, %v", frames, err)
+			}
+			if s {
+				shared.Add(1)
+			}
+		}()
+	}
+	// Give every caller the chance to join before the execution finishes.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if runs.Load() != 1 {
+		t.Errorf("expected a single execution, got %d", runs.Load())
+	}
+	if shared.Load() != 4 {
+		t.Errorf("expected 4 callers to share the execution, got %d", shared.Load())
+	}
+}
+
+func TestCoalescerCancellation(t *testing.T) {
+	c := newCoalescer()
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	fn := func(ctx context.Context) (data.Frames, error) {
+		close(started)
+		select {
+		case <-release:
+			return data.Frames{data.NewFrame("A")}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// The caller that started the execution leaves, the one that joined it still gets the result.
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, err, _ := c.Do(leaderCtx, "key", fn)
+		leaderErr <- err
+	}()
+	<-started
+
+	result := make(chan error)
+	go func() {
+		_, err, _ := c.Do(context.Background(), "key", fn)
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	cancelLeader()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the leaving caller to be cancelled, got %v", err)
+	}
+	close(release)
+	if err := <-result; err != nil {
+		t.Errorf("expected the remaining caller to get the result, got %v", err)
+	}
+
+	// Once every caller has left, the execution itself is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err, _ := c.Do(ctx, "other", func(ctx context.Context) (data.Frames, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the execution to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("execution was not cancelled after every caller left")
+	}
+}
+
+func TestInflightKey(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path": "", "deniedTableFunctions": ["glob"], "policyExemptRoles": ["Admin"]}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dashboard := classifyRequest(context.Background(), &backend.QueryDataRequest{})
+	alerting := classifyRequest(context.Background(), &backend.QueryDataRequest{Headers: map[string]string{"FromAlert": "true"}})
+	viewer := backend.WithUser(dashboard, &backend.User{Login: "viewer", Role: "Viewer"})
+	editor := backend.WithUser(dashboard, &backend.User{Login: "editor", Role: "Editor"})
+	admin := backend.WithUser(dashboard, &backend.User{Login: "admin", Role: "Admin"})
+
+	if ds.inflightKey(viewer, "q") != ds.inflightKey(editor, "q") {
+		t.Error("expected users the policy applies to alike to share queries")
+	}
+	if ds.inflightKey(dashboard, "q") == ds.inflightKey(alerting, "q") {
+		t.Error("expected alerting queries not to share dashboard queries")
+	}
+	if ds.inflightKey(viewer, "q") == ds.inflightKey(admin, "q") {
+		t.Error("expected users exempt from the policy not to share queries of other users")
+	}
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/sqlds/v3"
+)
+
+// The schemas and tables of these databases are not offered for completion: system holds the
+// catalog views and temp the temporary tables of single connections.
+const completionExcludedDatabases = "('system', 'temp')"
+
+// completionQuoted is the SQL quoting the identifier %s, like quoteIdentifier does. The parts of
+// qualified names are quoted, so that a name containing a dot is not taken for two.
+const completionQuoted = `'"' || replace(%s, '"', '""') || '"'`
+
+// completionQualified returns the SQL joining the columns holding the parts of a qualified name.
+func completionQualified(columns ...string) string {
+	parts := make([]string, len(columns))
+	for i, column := range columns {
+		parts[i] = fmt.Sprintf(completionQuoted, column)
+	}
+	return strings.Join(parts, " || '.' || ")
+}
+
+// Schemas lists the schemas of the attached databases for the /schemas resource. Given the
+// "database" option, it lists the schema names of that database only. Otherwise schemas outside
+// of the current database are qualified with their database, like "other"."main".
+func (d *SQLDataSourceWrapper) Schemas(ctx context.Context, options sqlds.Options) ([]string, error) {
+	return d.completions(ctx, `
+		SELECT CASE WHEN $1 <> '' OR catalog_name = current_database() THEN schema_name ELSE `+completionQualified("catalog_name", "schema_name")+` END
+		FROM information_schema.schemata
+		WHERE ($1 = '' OR catalog_name = $1)
+			AND catalog_name NOT IN `+completionExcludedDatabases+`
+			AND schema_name NOT IN ('information_schema', 'pg_catalog')
+		ORDER BY catalog_name <> current_database(), catalog_name, schema_name`,
+		options["database"])
+}
+
+// Tables lists the tables and views of the attached databases for the /tables resource, optionally
+// those of the "database" and "schema" options only. Names are qualified as far as needed to
+// query them: the current database and the main schema are left out unless given as options.
+func (d *SQLDataSourceWrapper) Tables(ctx context.Context, options sqlds.Options) ([]string, error) {
+	return d.completions(ctx, `
+		SELECT CASE
+			WHEN $1 <> '' OR table_catalog = current_database() THEN
+				CASE WHEN $2 <> '' OR table_schema = 'main' THEN table_name ELSE `+completionQualified("table_schema", "table_name")+` END
+			ELSE `+completionQualified("table_catalog", "table_schema", "table_name")+`
+		END
+		FROM information_schema.tables
+		WHERE ($1 = '' OR table_catalog = $1)
+			AND ($2 = '' OR table_schema = $2)
+			AND table_catalog NOT IN `+completionExcludedDatabases+`
+			AND table_schema NOT IN ('information_schema', 'pg_catalog')
+		ORDER BY table_catalog <> current_database(), table_catalog, table_schema <> 'main', table_schema, table_name`,
+		options["database"], options["schema"])
+}
+
+// Columns lists the columns of the "table" option for the /columns resource, in the order of the
+// table. The "database" and "schema" options pick the table when several databases or schemas
+// have one with that name; otherwise the table of the current database and main schema comes
+// first.
+func (d *SQLDataSourceWrapper) Columns(ctx context.Context, options sqlds.Options) ([]string, error) {
+	if options["table"] == "" {
+		return nil, fmt.Errorf("%w: the table option is required", sqlds.ErrorWrongOptions)
+	}
+	return d.completions(ctx, `
+		SELECT column_name
+		FROM duckdb_columns()
+		WHERE table_name = $1
+			AND ($2 = '' OR database_name = $2)
+			AND ($3 = '' OR schema_name = $3)
+			AND database_name NOT IN `+completionExcludedDatabases+`
+		QUALIFY dense_rank() OVER (ORDER BY database_name <> current_database(), database_name, schema_name <> 'main', schema_name) = 1
+		ORDER BY column_index`,
+		options["table"], options["database"], options["schema"])
+}
+
+// completions runs a query listing names for completion on the default connection.
+func (d *SQLDataSourceWrapper) completions(ctx context.Context, query string, args ...any) ([]string, error) {
+	names := []string{}
+	err := d.queryResource(ctx, query, args, func(rows *sql.Rows) error {
+		var name sql.NullString
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name.Valid && strings.TrimSpace(name.String) != "" {
+			names = append(names, name.String)
+		}
+		return nil
+	})
+	return names, err
+}
@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestCompletion(t *testing.T) {
+	initSQL := "CREATE TABLE metrics (ts TIMESTAMP, host VARCHAR, value DOUBLE);" +
+		"CREATE SCHEMA staging; CREATE TABLE staging.metrics (raw VARCHAR);" +
+		"ATTACH ':memory:' AS other; CREATE TABLE other.main.hosts (name VARCHAR, region VARCHAR);" +
+		`CREATE SCHEMA "raw.v2"; CREATE TABLE "raw.v2".events (id INTEGER);`
+	settings, _ := json.Marshal(map[string]any{"path": "", "initSql": initSQL})
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		options  map[string]string
+		status   int
+		expected []string
+	}{
+		{"schemas", "schemas", nil, http.StatusOK, []string{"main", "raw.v2", "staging", `"other"."main"`}},
+		{"schemas of a database", "schemas", map[string]string{"database": "other"}, http.StatusOK, []string{"main"}},
+		{"tables", "tables", nil, http.StatusOK, []string{"metrics", `"raw.v2"."events"`, `"staging"."metrics"`, `"other"."main"."hosts"`}},
+		{"tables of a schema", "tables", map[string]string{"schema": "staging"}, http.StatusOK, []string{"metrics"}},
+		{"tables of a database", "tables", map[string]string{"database": "other"}, http.StatusOK, []string{"hosts"}},
+		{"columns", "columns", map[string]string{"table": "metrics"}, http.StatusOK, []string{"ts", "host", "value"}},
+		{"columns of a schema", "columns", map[string]string{"table": "metrics", "schema": "staging"}, http.StatusOK, []string{"raw"}},
+		{"columns of an attached database", "columns", map[string]string{"table": "hosts"}, http.StatusOK, []string{"name", "region"}},
+		{"columns without a table", "columns", nil, http.StatusBadRequest, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body, _ := json.Marshal(tc.options)
+			resp := callResource(t, ds, tc.path, body)
+			if resp.Status != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, resp.Status, resp.Body)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			var names []string
+			if err := json.Unmarshal(resp.Body, &names); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, names)
+			}
+		})
+	}
+}
+
+// callResource calls the resource route at path of ds with body.
+func callResource(t *testing.T, ds *SQLDataSourceWrapper, path string, body []byte) *backend.CallResourceResponse {
+	t.Helper()
+	var resp *backend.CallResourceResponse
+	err := ds.CallResource(context.Background(), &backend.CallResourceRequest{
+		Path:   path,
+		Method: http.MethodPost,
+		Body:   body,
+	}, backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+		resp = r
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
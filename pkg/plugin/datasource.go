@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -21,6 +22,8 @@ import (
 var (
 	_ backend.QueryDataHandler      = (*SQLDataSourceWrapper)(nil)
 	_ backend.CheckHealthHandler    = (*SQLDataSourceWrapper)(nil)
+	_ backend.StreamHandler         = (*SQLDataSourceWrapper)(nil)
+	_ sqlds.Completable             = (*SQLDataSourceWrapper)(nil)
 	_ instancemgmt.InstanceDisposer = (*SQLDataSourceWrapper)(nil)
 )
 
@@ -35,6 +38,26 @@ func (ds *SQLDataSourceWrapper) NewDatasource(ctx context.Context, settings back
 	}
 
 	ds.fileWatcher = NewFileWatcher(config.Path)
+	ds.metrics = sqlds.NewMetrics(settings.Name, settings.Type, sqlds.EndpointQuery)
+	ds.cache = newResultCache(config)
+	ds.incremental = newIncrementalCache(config)
+	ds.inflight = newCoalescer()
+	ds.admission = newAdmissionController(config, ds.metrics)
+	ds.memory = newMemoryGuard(config)
+	ds.profiling = config.Profiling
+	if config.Profiling && config.Sandbox {
+		// Profiling is enabled per connection, which the locked configuration of the sandbox forbids.
+		backend.Logger.Warn("Query profiling is not available when the sandbox is enabled")
+		ds.profiling = false
+	}
+	ds.readOnly = config.ReadOnly
+	ds.policy = newQueryPolicy(config)
+	ds.streams = newStreamRegistry(config)
+	ds.streams.removeStaleCursors(settings.UID)
+	ds.functions = &functionCatalog{}
+	// Must be set before sqlds registers the resource routes.
+	ds.Completable = ds
+	ds.CustomRoutes = ds.customRoutes()
 
 	newSqlDs, err := ds.SQLDatasource.NewDatasource(ctx, settings)
 	if err != nil {
@@ -82,14 +105,27 @@ func (f *FileWatcher) HasUpdate() bool {
 type SQLDataSourceWrapper struct {
 	*sqlds.SQLDatasource
 
+	driver      sqlds.Driver
 	fileWatcher *FileWatcher
+	cache       *resultCache
+	incremental *resultCache
+	inflight    *coalescer
+	admission   *admissionController
+	memory      *memoryGuard
+	profiling   bool
+	readOnly    bool
+	policy      *queryPolicy
+	streams     *streamRegistry
+	functions   *functionCatalog
 	settings    backend.DataSourceInstanceSettings
+	metrics     sqlds.Metrics
 }
 
 // NewDatasource initializes the Datasource wrapper and instance manager
 func NewDatasource(c sqlds.Driver) *SQLDataSourceWrapper {
 	return &SQLDataSourceWrapper{
 		SQLDatasource: sqlds.NewDatasource(c),
+		driver:        c,
 	}
 }
 
@@ -115,11 +151,51 @@ func (d *SQLDataSourceWrapper) QueryData(ctx context.Context, req *backend.Query
 			return nil, err
 		}
 		d.SQLDatasource = newSqlDs.(*sqlds.SQLDatasource)
+		if d.cache != nil {
+			d.cache.Purge()
+		}
+		d.incremental.Purge()
+		d.functions.Purge()
+	}
+
+	ctx = classifyRequest(ctx, req)
+	if req.PluginContext.User != nil {
+		ctx = backend.WithUser(ctx, req.PluginContext.User)
+	}
+	headers := req.GetHTTPHeaders()
+
+	var (
+		response = sqlds.NewResponse(backend.NewQueryDataResponse())
+		wg       = sync.WaitGroup{}
+	)
+
+	wg.Add(len(req.Queries))
+
+	// Execute each query and store the results by query RefID
+	for _, q := range req.Queries {
+		go func(query backend.DataQuery) {
+			defer wg.Done()
+
+			frames, err := d.handleQuery(ctx, query, headers)
+			if err == nil {
+				if mutator, ok := d.driver.(sqlds.ResponseMutator); ok {
+					frames, err = mutator.MutateResponse(ctx, frames)
+					if err != nil {
+						err = sqlds.PluginError(err)
+					}
+				}
+			}
+			response.Set(query.RefID, backend.DataResponse{
+				Frames:      frames,
+				Error:       err,
+				ErrorSource: sqlds.ErrorSource(err),
+			})
+		}(q)
 	}
 
-	response, err := d.SQLDatasource.QueryData(ctx, req)
+	wg.Wait()
 
-	return response, err
+	return response.Response(), nil
 }
 
 // CheckHealth handles health checks sent from Grafana to the plugin.
@@ -2,13 +2,22 @@ package plugin
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/sqlds/v3"
 )
 
 func TestQueryData(t *testing.T) {
@@ -188,3 +197,489 @@ func TestMultipleQueriesRequest(t *testing.T) {
 		}
 	}
 }
+
+// longRunningQuery keeps DuckDB busy far longer than any test is willing to wait.
+const longRunningQuery = `{"rawSql": "SELECT sum(hash(i)) FROM range(1000000000000) t(i);"}`
+
+func TestQueryCancellation(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":""}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	resp, err := ds.QueryData(ctx, &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: json.RawMessage(longRunningQuery)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled query took %s to stop", elapsed)
+	}
+	if !errors.Is(resp.Responses["A"].Error, context.Canceled) {
+		t.Errorf("expected a cancellation error, got: %v", resp.Responses["A"].Error)
+	}
+
+	db, err := ds.GetDBFromQuery(context.Background(), &sqlutil.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inUse := db.Stats().InUse; inUse != 0 {
+		t.Errorf("expected the connection to be released, %d still in use", inUse)
+	}
+
+	resp, err = ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "B", JSON: json.RawMessage(`{"rawSql": "SELECT 1;"}`)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Responses["B"].Error != nil {
+		t.Errorf("query after cancellation failed: %v", resp.Responses["B"].Error)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "queryTimeout": 1}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: json.RawMessage(longRunningQuery)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The driver settings allow 3 retries, timed out queries must not use them.
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("timed out query took %s to stop", elapsed)
+	}
+	if !errors.Is(resp.Responses["A"].Error, sqlds.ErrorTimeout) {
+		t.Errorf("expected a timeout error, got: %v", resp.Responses["A"].Error)
+	}
+
+	db, err := ds.GetDBFromQuery(context.Background(), &sqlutil.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inUse := db.Stats().InUse; inUse != 0 {
+		t.Errorf("expected the connection to be released, %d still in use", inUse)
+	}
+}
+
+// hooksDriver implements the optional sqlds driver hooks on top of the DuckDB driver.
+type hooksDriver struct {
+	*DuckDBDriver
+	mutated bool
+}
+
+func (d *hooksDriver) Settings(ctx context.Context, settings backend.DataSourceInstanceSettings) sqlds.DriverSettings {
+	s := d.DuckDBDriver.Settings(ctx, settings)
+	s.RetryOn = []string{"transient"}
+	s.Pause = 0
+	return s
+}
+
+func (d *hooksDriver) MutateQuery(ctx context.Context, req backend.DataQuery) (context.Context, backend.DataQuery) {
+	req.JSON = []byte(strings.ReplaceAll(string(req.JSON), "$table", "attempts"))
+	return ctx, req
+}
+
+func (d *hooksDriver) SetQueryArgs(ctx context.Context, headers http.Header) []any {
+	return []any{headers.Get("X-Tenant")}
+}
+
+func (d *hooksDriver) MutateResponse(ctx context.Context, frames data.Frames) (data.Frames, error) {
+	d.mutated = true
+	return frames, nil
+}
+
+func TestDriverHooks(t *testing.T) {
+	driver := &hooksDriver{DuckDBDriver: &DuckDBDriver{Initialized: false}}
+	ds := NewDatasource(driver)
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":""}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := ds.GetDBFromQuery(context.Background(), &sqlutil.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE SEQUENCE attempts"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The query fails twice with a message the driver retries on before it succeeds.
+	model, _ := json.Marshal(map[string]any{
+		"format": 1,
+		"rawSql": "SELECT CASE WHEN nextval('$table') < 3 THEN error('transient failure') ELSE $1 END AS tenant",
+	})
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Headers: map[string]string{"http_X-Tenant": "acme"},
+		Queries: []backend.DataQuery{{RefID: "A", JSON: model}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resp.Responses["A"]
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if v, ok := res.Frames[0].Fields[0].ConcreteAt(0); !ok || v != "acme" {
+		t.Errorf("expected the query argument, got %v", v)
+	}
+	if !driver.mutated {
+		t.Error("expected the response to be mutated")
+	}
+}
+
+func TestMultiStatementQuery(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "maxOpenConns": 1}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(rawSQL string) backend.DataResponse {
+		t.Helper()
+		model, _ := json.Marshal(map[string]any{"rawSql": rawSQL, "format": 1})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: model}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Responses["A"]
+	}
+
+	res := query(`SET VARIABLE answer = 42;
+		CREATE TEMP TABLE setup AS SELECT 'a;b' AS s;
+		SELECT getvariable('answer') AS answer, s FROM setup;`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	frame := res.Frames[0]
+	if len(frame.Fields) != 2 || frame.Rows() != 1 {
+		t.Fatalf("expected the result of the last statement only, got %d fields and %d rows", len(frame.Fields), frame.Rows())
+	}
+	if s, ok := frame.Fields[1].ConcreteAt(0); !ok || s != "a;b" {
+		t.Errorf("expected 'a;b', got %v", s)
+	}
+
+	// The setup must not leak into later queries borrowing a connection from the pool.
+	res = query(`SELECT getvariable('answer') AS answer;`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if v, ok := res.Frames[0].Fields[0].ConcreteAt(0); ok {
+		t.Errorf("expected variable to be unset, got %v", v)
+	}
+	if res = query(`SELECT * FROM setup;`); res.Error == nil {
+		t.Error("expected temp table to be gone")
+	}
+
+	// Setup statements changing the whole database are rejected, discarding the connection would
+	// not undo them.
+	threads := func() any {
+		t.Helper()
+		res := query(`SELECT current_setting('threads')::VARCHAR AS threads`)
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		v, _ := res.Frames[0].Fields[0].ConcreteAt(0)
+		return v
+	}
+	before := threads()
+	for _, rawSQL := range []string{
+		"SET threads = 1; SELECT 1 AS v",
+		"SET GLOBAL threads = 1; SELECT 1 AS v",
+		"CREATE TABLE kept AS SELECT 1 AS v; SELECT 1 AS v",
+		"ATTACH ':memory:' AS other; SELECT 1 AS v",
+	} {
+		if res := query(rawSQL); res.Error == nil || !strings.Contains(res.Error.Error(), "cannot precede the final statement") {
+			t.Errorf("%s: expected the setup to be rejected, got: %v", rawSQL, res.Error)
+		}
+	}
+	if after := threads(); after != before {
+		t.Errorf("expected the threads setting of the next query to stay %v, got %v", before, after)
+	}
+	res = query(`/* setup */ SET SESSION TimeZone = 'Asia/Tokyo'; USE memory; SELECT current_setting('TimeZone') AS tz`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if tz, _ := res.Frames[0].Fields[0].ConcreteAt(0); tz != "Asia/Tokyo" {
+		t.Errorf("expected the session setting to apply to the final statement, got %v", tz)
+	}
+}
+
+func TestResourceLimits(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "memoryLimit": "256MB", "threads": 2, "maxTempDirectorySize": "1GB", "memoryWatermark": 10}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(rawSQL string) backend.DataResponse {
+		t.Helper()
+		model, _ := json.Marshal(map[string]any{"rawSql": rawSQL, "format": 1})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: model}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Responses["A"]
+	}
+
+	res := query(`SELECT current_setting('memory_limit')::VARCHAR AS memory_limit, current_setting('threads')::VARCHAR AS threads`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if v, _ := res.Frames[0].Fields[0].ConcreteAt(0); v != "244.1 MiB" {
+		t.Errorf("expected a memory limit of 256MB, got %v", v)
+	}
+	if v, _ := res.Frames[0].Fields[1].ConcreteAt(0); v != "2" {
+		t.Errorf("expected 2 threads, got %v", v)
+	}
+
+	// About 80MB of table data puts the in-memory database above 10% of its memory limit.
+	if res = query(`CREATE TABLE filler AS SELECT i, i AS j FROM range(5000000) t(i)`); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if res = query(`SELECT 1 AS ok`); !errors.Is(res.Error, ErrorMemoryPressure) {
+		t.Errorf("expected the query to be rejected under memory pressure, got: %v", res.Error)
+	}
+	if res.ErrorSource != backend.ErrorSourceDownstream {
+		t.Errorf("expected a downstream error, got %s", res.ErrorSource)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"953.6 MiB": 999922073,
+		"4GB":       4000000000,
+		"1.5 KiB":   1536,
+		"0 bytes":   0,
+	} {
+		got, err := parseSize(in)
+		if err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v, expected %d", in, got, err, want)
+		}
+	}
+	if _, err := parseSize("lots"); err == nil {
+		t.Error("expected an error for an invalid size")
+	}
+}
+
+func TestExplainQuery(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "cacheTTL": 60}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(rawSQL, mode string) backend.DataResponse {
+		t.Helper()
+		model, _ := json.Marshal(map[string]any{"rawSql": rawSQL, "format": 1, "explain": mode})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: model}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Responses["A"]
+	}
+
+	for mode, want := range map[string]string{"explain": "PROJECTION", "analyze": "Total Time"} {
+		res := query("SELECT sum(i) AS total FROM range(10) t(i)", mode)
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		frame := res.Frames[0]
+		if frame.Fields[0].Name != "plan" || frame.Rows() < 2 {
+			t.Fatalf("expected the plan one line per row, got %d rows", frame.Rows())
+		}
+		if len(frame.Meta.Notices) != 1 || !strings.Contains(frame.Meta.Notices[0].Text, want) {
+			t.Errorf("expected a %s notice containing %q", mode, want)
+		}
+		if !strings.HasPrefix(frame.Meta.ExecutedQueryString, "EXPLAIN") {
+			t.Errorf("expected the executed query to be explained, got %q", frame.Meta.ExecutedQueryString)
+		}
+	}
+
+	if res := query("SET VARIABLE x = 1; SELECT getvariable('x') AS x", "explain"); res.Error == nil {
+		t.Error("expected multi-statement queries to be rejected in explain mode")
+	}
+	if res := query("SELECT 1 AS x", "bogus"); res.Error == nil {
+		t.Error("expected an unknown explain mode to be rejected")
+	}
+}
+
+func TestQueryProfiling(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "profiling": true, "maxOpenConns": 1, "initSql": "CREATE TABLE points AS SELECT TIMESTAMP '2024-01-01' + to_minutes(i) AS ts, i % 3 AS host, i AS v FROM range(0, 100) t(i);"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []sqlutil.FormatQueryOption{sqlutil.FormatOptionTable, sqlutil.FormatOptionTimeSeries, sqlutil.FormatOptionMulti} {
+		model, _ := json.Marshal(map[string]any{"rawSql": "SELECT ts AS time, host::VARCHAR AS host, v FROM points ORDER BY ts", "format": format})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: model}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := resp.Responses["A"]
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		for _, frame := range res.Frames {
+			custom, ok := frame.Meta.Custom.(map[string]any)
+			if !ok {
+				t.Fatalf("format %d: expected a profile in the frame metadata", format)
+			}
+			profile := custom["profile"].(*queryProfile)
+			if profile.RowsScanned != 100 || len(profile.Operators) == 0 {
+				t.Errorf("format %d: expected 100 rows scanned by the operator tree, got %+v", format, profile)
+			}
+			if len(frame.Meta.Stats) == 0 {
+				t.Errorf("format %d: expected query stats", format)
+			}
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "points.csv")
+	if err := os.WriteFile(path, []byte("ts,v\n2024-01-01,1\n2024-01-02,2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	model, _ := json.Marshal(map[string]any{"rawSql": fmt.Sprintf("SELECT * FROM read_csv('%s')", path), "format": sqlutil.FormatOptionTable})
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: model}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resp.Responses["A"]
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	profile := res.Frames[0].Meta.Custom.(map[string]any)["profile"].(*queryProfile)
+	if profile.BytesRead == 0 || profile.PeakBufferMemory == 0 {
+		t.Errorf("expected the bytes read and the peak buffer memory, got %+v", profile)
+	}
+
+	// The connection goes back to the pool with profiling disabled.
+	db, err := ds.GetDBFromQuery(context.Background(), &sqlutil.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mode sql.NullString
+	if err := db.QueryRow("SELECT current_setting('enable_profiling')").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode.String != "" {
+		t.Errorf("expected profiling to be reset on the pooled connection, got %q", mode.String)
+	}
+	if stats := db.Stats(); stats.Idle == 0 {
+		t.Errorf("expected the connection to be pooled, got %+v", stats)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	allowedDir, deniedDir := t.TempDir(), t.TempDir()
+	for _, dir := range []string{allowedDir, deniedDir} {
+		if err := os.WriteFile(filepath.Join(dir, "data.csv"), []byte("v\n1\n2\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	initSQL := fmt.Sprintf("CREATE TABLE boot AS SELECT * FROM read_csv('%s');", filepath.Join(deniedDir, "data.csv"))
+	settings, _ := json.Marshal(map[string]any{
+		"path":               "",
+		"initSql":            initSQL,
+		"sandbox":            true,
+		"allowedDirectories": []string{allowedDir},
+	})
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		permission = "Permission Error"
+		locked     = "the configuration has been locked"
+	)
+	tests := []struct {
+		name   string
+		sql    string
+		denied string
+	}{
+		{"InitSql ran before the sandbox", "SELECT count(*) AS n FROM boot", ""},
+		{"allowed directory", fmt.Sprintf("SELECT sum(v) AS total FROM read_csv('%s')", filepath.Join(allowedDir, "data.csv")), ""},
+		{"file queried as a table in an allowed directory", fmt.Sprintf("SELECT sum(v) AS total FROM '%s'", filepath.Join(allowedDir, "data.csv")), ""},
+		{"denied directory", fmt.Sprintf("SELECT sum(v) AS total FROM read_csv('%s')", filepath.Join(deniedDir, "data.csv")), permission},
+		{"system file", "SELECT * FROM read_text('/etc/passwd')", permission},
+		{"path traversal", fmt.Sprintf("SELECT * FROM read_csv('%s/../%s/data.csv')", allowedDir, filepath.Base(deniedDir)), permission},
+		{"glob outside the allowed directories", "SELECT * FROM glob('/etc/*')", permission},
+		{"remote URL", "SELECT * FROM read_csv('http://127.0.0.1:9/data.csv')", permission},
+		{"attach", fmt.Sprintf("ATTACH '%s' AS other", filepath.Join(deniedDir, "other.duckdb")), permission},
+		{"re-enable external access", "SET enable_external_access = true", locked},
+		{"unlock the configuration", "SET lock_configuration = false", locked},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			model, _ := json.Marshal(map[string]any{"rawSql": tc.sql, "format": 1})
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{{RefID: "A", JSON: model}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := resp.Responses["A"]
+			if tc.denied == "" {
+				if res.Error != nil {
+					t.Fatal(res.Error)
+				}
+				return
+			}
+			if res.Error == nil || !strings.Contains(res.Error.Error(), tc.denied) {
+				t.Errorf("expected the query to be denied with %q, got: %v", tc.denied, res.Error)
+			}
+		})
+	}
+}
+
+func TestSandboxMotherDuck(t *testing.T) {
+	settings, _ := json.Marshal(map[string]any{"path": "md:sample_data", "sandbox": true})
+	_, err := (&DuckDBDriver{}).Connect(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData:                settings,
+		DecryptedSecureJSONData: map[string]string{"motherDuckToken": "token"},
+	}, nil)
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) || !strings.Contains(err.Error(), "sandbox") {
+		t.Errorf("expected the sandbox to be rejected for a MotherDuck connection, got: %v", err)
+	}
+}
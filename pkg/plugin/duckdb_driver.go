@@ -35,6 +35,17 @@ func (e *ConfigError) Error() string {
 	return e.Msg
 }
 
+// defaultQueryTimeout is used when the datasource does not configure a query timeout.
+const defaultQueryTimeout = 30 * time.Second
+
+// queryTimeout returns the hard per-query deadline configured for the datasource.
+func queryTimeout(config *models.PluginSettings) time.Duration {
+	if config.QueryTimeout > 0 {
+		return time.Duration(config.QueryTimeout) * time.Second
+	}
+	return defaultQueryTimeout
+}
+
 type DuckDBDriver struct {
 	mu          sync.Mutex
 	Initialized bool
@@ -58,6 +69,7 @@ func (d *DuckDBDriver) Connect(ctx context.Context, settings backend.DataSourceI
 
 	// Determine connector path based on input
 	var path string
+	var readOnly bool
 	trimmedPath := strings.TrimSpace(config.Path)
 
 	// Check for invalid path with quotes
@@ -72,21 +84,43 @@ func (d *DuckDBDriver) Connect(ctx context.Context, settings backend.DataSourceI
 		if config.Secrets.MotherDuckToken == "" {
 			return nil, &ConfigError{"MotherDuck Token is missing for motherduck connection"}
 		}
+		if config.Sandbox {
+			// The sandbox disables external access, which MotherDuck needs for every query.
+			return nil, &ConfigError{"The sandbox cannot be enabled for a MotherDuck connection, it blocks access to MotherDuck"}
+		}
 		path = ""
 	} else if trimmedPath != "" {
 		// Local file: use the path directly as connector path
 		path = trimmedPath
 		backend.Logger.Info("Local file path is: " + path)
+		// In-memory databases cannot be opened read-only.
+		readOnly = config.ReadOnly && !strings.HasPrefix(trimmedPath, ":memory:")
 	} else {
 		// Empty: in-memory database
 		path = ""
 	}
-	// Set custom_user_agent via DSN parameter (must be set at connection open time)
+	if config.Sandbox && config.Secrets.MotherDuckToken != "" {
+		backend.Logger.Warn("The sandbox blocks access to MotherDuck databases attached by the Init SQL")
+	}
+	// Set custom_user_agent and resource limits via DSN parameters (must be set at connection open time)
+	options, err := resourceOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	options.Set("custom_user_agent", "grafana")
+	if readOnly {
+		// Queries are checked for non-SELECT statements before they run, opening the file read-only
+		// also keeps InitSql from writing to it.
+		options.Set("access_mode", "READ_ONLY")
+	}
 	sep := "?"
 	if strings.Contains(path, "?") {
 		sep = "&"
 	}
-	path += sep + "custom_user_agent=grafana"
+	path += sep + options.Encode()
+	// The sandbox is applied to every database this connector opens, also when the boot queries
+	// already ran for an earlier database of the driver.
+	sandboxed := false
 	// connect with the path before any other queries are run.
 	connector, err := duckdb.NewConnector(path, func(execer driver.ExecerContext) error {
 		d.mu.Lock()
@@ -123,8 +157,10 @@ func (d *DuckDBDriver) Connect(ctx context.Context, settings backend.DataSourceI
 			if strings.TrimSpace(config.InitSql) != "" {
 				bootQueries = append(bootQueries, config.InitSql)
 			}
+			// The query timeout is not applied to the boot queries: installing an extension or
+			// running InitSql may take longer than any query, and the connection outlives the
+			// request that opened it.
 			for _, query := range bootQueries {
-				// TODO: Fix context cancellation happening somewhere in the plugin.
 				_, err = execer.ExecContext(context.Background(), query, nil)
 				if err != nil {
 					return err
@@ -134,6 +170,15 @@ func (d *DuckDBDriver) Connect(ctx context.Context, settings backend.DataSourceI
 			d.Initialized = true
 		}
 
+		if config.Sandbox && !sandboxed {
+			for _, query := range sandboxQueries(config) {
+				if _, err := execer.ExecContext(context.Background(), query, nil); err != nil {
+					return fmt.Errorf("could not apply the sandbox: %w", err)
+				}
+			}
+			sandboxed = true
+		}
+
 		return nil
 	})
 
@@ -153,8 +198,12 @@ func (d *DuckDBDriver) Connect(ctx context.Context, settings backend.DataSourceI
 }
 
 func (d *DuckDBDriver) Settings(ctx context.Context, settings backend.DataSourceInstanceSettings) sqlds.DriverSettings {
+	timeout := defaultQueryTimeout
+	if config, err := models.LoadPluginSettings(settings); err == nil {
+		timeout = queryTimeout(config)
+	}
 	return sqlds.DriverSettings{
-		Timeout:        30 * time.Second,
+		Timeout:        timeout,
 		FillMode:       &data.FillMissing{Mode: data.FillModeNull},
 		Retries:        3,
 		Pause:          100,
@@ -171,8 +220,9 @@ func (d *DuckDBDriver) FillMode() *data.FillMissing {
 
 func (d *DuckDBDriver) Macros() sqlds.Macros {
 	return sqlutil.Macros{
-		"timeFrom": macroTimeFrom,
-		"timeTo":   macroTimeTo,
+		"timeFrom":  macroTimeFrom,
+		"timeTo":    macroTimeTo,
+		"histogram": macroHistogram,
 	}
 }
 
@@ -258,6 +308,50 @@ func (n *NullBigInt) Value() (driver.Value, error) {
 	return n.BigInt, nil
 }
 
+// NullNested holds the value of a STRUCT, MAP or LIST column, which the driver returns as Go maps
+// and slices.
+type NullNested struct {
+	Nested any
+	Valid  bool
+}
+
+func (n *NullNested) Scan(value any) error {
+	n.Nested = value
+	n.Valid = value != nil
+	return nil
+}
+
+func (n *NullNested) Value() (driver.Value, error) {
+	if !n.Valid {
+		return nil, nil
+	}
+	return n.Nested, nil
+}
+
+// nestedConverter encodes STRUCT, MAP and LIST columns as JSON. It is not in GetConverterList: it
+// is only used for the formats that read nested values, see runQuery.
+var nestedConverter = sqlutil.Converter{
+	Name:          "handle nested types (STRUCT, MAP, LIST)",
+	InputScanType: reflect.TypeOf(NullNested{}),
+	// Lists are named after their element type, like INTEGER[] or VARCHAR[3] for arrays.
+	InputTypeRegex: regexp.MustCompile(`^(STRUCT|MAP)\(|\[\d*\]$`),
+	FrameConverter: sqlutil.FrameConverter{
+		FieldType: data.FieldTypeNullableJSON,
+		ConverterFunc: func(in interface{}) (interface{}, error) {
+			v := in.(*NullNested)
+			if !v.Valid {
+				return (*json.RawMessage)(nil), nil
+			}
+			encoded, err := json.Marshal(v.Nested)
+			if err != nil {
+				return nil, err
+			}
+			msg := json.RawMessage(encoded)
+			return &msg, nil
+		},
+	},
+}
+
 func GetConverterList() []sqlutil.Converter {
 	// NEED:
 	// NULL to uint64, uint32, uint16, uint8,  not supported
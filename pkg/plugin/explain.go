@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/sqlds/v3"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+// explainQuery runs the macro-expanded q under EXPLAIN or EXPLAIN ANALYZE and returns the plan as
+// a frame with one row per line, along with a notice holding the whole plan, so that it can be
+// read in the query inspector.
+func (d *SQLDataSourceWrapper) explainQuery(ctx context.Context, q *sqlutil.Query, mode string) (data.Frames, error) {
+	var prefix string
+	switch mode {
+	case models.ExplainModePlan:
+		prefix = "EXPLAIN "
+	case models.ExplainModeAnalyze:
+		prefix = "EXPLAIN ANALYZE "
+	default:
+		return nil, sqlds.PluginError(fmt.Errorf("unknown explain mode %q, expected %q or %q", mode, models.ExplainModePlan, models.ExplainModeAnalyze))
+	}
+	if err := requireSingleStatement(q.RawSQL, "explain mode"); err != nil {
+		return nil, err
+	}
+
+	explain := *q
+	explain.RawSQL = prefix + q.RawSQL
+	result, err := d.runQuery(ctx, &explain)
+	if err != nil {
+		return nil, err
+	}
+
+	var plans []string
+	valueIdx := len(result.Fields) - 1
+	for i := 0; i < result.Rows(); i++ {
+		if plan, ok := result.Fields[valueIdx].ConcreteAt(i); ok {
+			plans = append(plans, strings.TrimRight(fmt.Sprint(plan), "\n"))
+		}
+	}
+	text := strings.Join(plans, "\n")
+
+	frame := data.NewFrame("plan", data.NewField("plan", nil, strings.Split(text, "\n")))
+	frame.RefID = q.RefID
+	frame.Meta = &data.FrameMeta{
+		ExecutedQueryString:    explain.RawSQL,
+		PreferredVisualization: data.VisTypeTable,
+		Notices: []data.Notice{{
+			Severity: data.NoticeSeverityInfo,
+			Text:     text,
+		}},
+	}
+	return data.Frames{frame}, nil
+}
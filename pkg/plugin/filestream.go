@@ -0,0 +1,323 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+	"github.com/grafana/sqlds/v3"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+// fileMacro is replaced with the path of the file a file stream reads.
+const fileMacro = "$__file"
+
+// fileStreamQuery returns the query reading file for a file stream query. Without a query the
+// whole file is read, DuckDB picks the reader from the extension.
+func fileStreamQuery(rawSQL string, file string) string {
+	quoted := "'" + strings.ReplaceAll(file, "'", "''") + "'"
+	if strings.TrimSpace(rawSQL) == "" {
+		return "SELECT * FROM " + quoted
+	}
+	return strings.ReplaceAll(rawSQL, fileMacro, quoted)
+}
+
+// fileCursor records the files a file stream has read, so they are not read again after a
+// restart.
+type fileCursor struct {
+	path  string
+	Files map[string]time.Time `json:"files"`
+}
+
+func defaultStreamCursorDirectory() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "grafana-duckdb-datasource", "cursors")
+}
+
+// streamCursorRetention is how long the cursor of a file stream is kept after the stream last
+// ran. The cursor of a query is left behind when the query is edited or removed.
+const streamCursorRetention = 7 * 24 * time.Hour
+
+// cursorPath returns the path of the cursor of the file stream of datasource uid at path.
+func (r *streamRegistry) cursorPath(uid string, path string) string {
+	return filepath.Join(r.cursorDirectory, uid+"-"+strings.TrimPrefix(path, "stream/")+".json")
+}
+
+// removeStaleCursors removes the cursors of datasource uid whose streams have not run within
+// streamCursorRetention.
+func (r *streamRegistry) removeStaleCursors(uid string) {
+	cursors, err := filepath.Glob(filepath.Join(r.cursorDirectory, uid+"-*.json"))
+	if err != nil {
+		return
+	}
+	for _, cursor := range cursors {
+		info, err := os.Stat(cursor)
+		if err != nil || time.Since(info.ModTime()) < streamCursorRetention {
+			continue
+		}
+		if err := os.Remove(cursor); err != nil && !errors.Is(err, os.ErrNotExist) {
+			backend.Logger.Warn("Could not remove the stream cursor", "cursor", cursor, "error", err)
+		}
+	}
+}
+
+// loadFileCursor reads the cursor at path. ok is false when there is none yet.
+func loadFileCursor(path string) (cursor *fileCursor, ok bool, err error) {
+	cursor = &fileCursor{path: path, Files: map[string]time.Time{}}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cursor, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal(content, cursor); err != nil {
+		return nil, false, fmt.Errorf("could not read the stream cursor %s: %w", path, err)
+	}
+	if cursor.Files == nil {
+		cursor.Files = map[string]time.Time{}
+	}
+	return cursor, true, nil
+}
+
+// save writes the cursor to a temporary file first, so a crash never leaves a truncated cursor.
+func (c *fileCursor) save() error {
+	content, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o750); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// maxStreamFileAttempts is how many polls in a row a file stream tries to read a file that fails,
+// before it records the file as read.
+const maxStreamFileAttempts = 5
+
+// pendingFile is a file a file stream has listed but not read yet.
+type pendingFile struct {
+	size     int64
+	modTime  time.Time
+	attempts int
+}
+
+// pendingFiles are the files a file stream has listed but not read yet, by path.
+type pendingFiles map[string]*pendingFile
+
+// stable reports whether file can be read: its size and modification time are the same as on the
+// previous poll, so it is no longer being written. The attempts to read a file start over when it
+// changes. Remote files, which cannot be stat'ed, are only visible once written and are always
+// stable.
+func (p pendingFiles) stable(file string) bool {
+	if strings.Contains(file, "://") {
+		return true
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	pending := p[file]
+	if pending != nil && pending.size == info.Size() && pending.modTime.Equal(info.ModTime()) {
+		return true
+	}
+	p[file] = &pendingFile{size: info.Size(), modTime: info.ModTime()}
+	return false
+}
+
+// failed records a failed attempt to read file and returns the number of attempts so far.
+func (p pendingFiles) failed(file string) int {
+	pending := p[file]
+	if pending == nil {
+		pending = &pendingFile{}
+		p[file] = pending
+	}
+	pending.attempts++
+	return pending.attempts
+}
+
+// startFileStream checks that the files of a file stream can be listed and returns an empty frame
+// with the Live channel the rows of new files are pushed to. q is the query with the glob in place
+// of the file, template the query with its macros unexpanded.
+func (d *SQLDataSourceWrapper) startFileStream(ctx context.Context, q *sqlutil.Query, template *sqlutil.Query, options *models.Stream, interval time.Duration) (data.Frames, error) {
+	if strings.TrimSpace(template.RawSQL) != "" && !strings.Contains(template.RawSQL, fileMacro) {
+		return nil, sqlds.DownstreamError(fmt.Errorf("%w: file stream queries must read the file with %s", sqlds.ErrorQuery, fileMacro))
+	}
+	// The files are listed with glob, which the read-only mode and the policy see apart from the
+	// query reading each file. Later polls list the same files, the listing is checked once for
+	// the user starting the stream.
+	if err := d.checkResourceQuery(ctx, streamFilesQuery(options.Files)); err != nil {
+		return nil, err
+	}
+	if _, err := d.listStreamFiles(ctx, q, options.Files); err != nil {
+		return nil, err
+	}
+
+	path := streamPath(template, options)
+	d.streams.set(path, &liveStream{
+		query:    *template,
+		interval: interval,
+		files:    options.Files,
+		cursor:   d.streams.cursorPath(d.settings.UID, path),
+	})
+
+	frame := data.NewFrame(q.RefID)
+	frame.Meta = &data.FrameMeta{
+		ExecutedQueryString:    q.RawSQL,
+		PreferredVisualization: data.VisTypeTable,
+		Channel:                live.Channel{Scope: live.ScopeDatasource, Namespace: d.settings.UID, Path: path}.String(),
+	}
+	return data.Frames{frame}, nil
+}
+
+// streamFilesQuery returns the query listing the files matching pattern.
+func streamFilesQuery(pattern string) string {
+	return fmt.Sprintf("SELECT file FROM glob('%s') ORDER BY file", strings.ReplaceAll(pattern, "'", "''"))
+}
+
+// listStreamFiles lists the files matching pattern with DuckDB, so the sandbox applies.
+func (d *SQLDataSourceWrapper) listStreamFiles(ctx context.Context, q *sqlutil.Query, pattern string) ([]string, error) {
+	list := *q
+	list.RawSQL = streamFilesQuery(pattern)
+	frame, err := d.runQuery(ctx, &list)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, frame.Rows())
+	for i := 0; i < frame.Rows(); i++ {
+		files = append(files, stringValue(frame.Fields[0], i))
+	}
+	return files, nil
+}
+
+// runFileStream reads the files matching the glob of stream that are not in its cursor and sends
+// their rows to the channel, until Grafana cancels ctx. The first run of a stream records the
+// files that are already there without reading them.
+func (d *SQLDataSourceWrapper) runFileStream(ctx context.Context, path string, stream *liveStream, sender *backend.StreamSender) error {
+	cursor, ok, err := loadFileCursor(stream.cursor)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		files, err := d.listStreamFiles(ctx, &stream.query, stream.files)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, file := range files {
+			cursor.Files[file] = now
+		}
+	}
+	// Saved on every run, so that the cursor of a stream still in use is not removed as stale.
+	if err := cursor.save(); err != nil {
+		return err
+	}
+
+	pending := pendingFiles{}
+	ticker := time.NewTicker(stream.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		files, err := d.listStreamFiles(ctx, &stream.query, stream.files)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			backend.Logger.Warn("Could not list the files of the stream", "path", path, "error", err)
+			continue
+		}
+		listed := make(map[string]bool, len(files))
+		for _, file := range files {
+			listed[file] = true
+			if _, ok := cursor.Files[file]; ok {
+				continue
+			}
+			if !pending.stable(file) {
+				continue
+			}
+			frame, err := d.readStreamFile(ctx, &stream.query, file)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				// A file that still cannot be read after a few polls is given up on, it would
+				// fail on every poll.
+				if pending.failed(file) < maxStreamFileAttempts {
+					backend.Logger.Debug("Could not read the file of the stream, retrying", "path", path, "file", file, "error", err)
+					continue
+				}
+				backend.Logger.Warn("Could not read the file of the stream", "path", path, "file", file, "error", err)
+			}
+			delete(pending, file)
+			cursor.Files[file] = time.Now()
+			if saveErr := cursor.save(); saveErr != nil {
+				return saveErr
+			}
+			if err != nil {
+				continue
+			}
+			if frame.Rows() == 0 {
+				continue
+			}
+			frame.Name = stream.query.RefID
+			if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+				return err
+			}
+		}
+
+		// Forget files that were removed from the directory, the cursor would grow forever.
+		for file := range pending {
+			if !listed[file] {
+				delete(pending, file)
+			}
+		}
+		pruned := false
+		for file := range cursor.Files {
+			if !listed[file] {
+				delete(cursor.Files, file)
+				pruned = true
+			}
+		}
+		if pruned {
+			if err := cursor.save(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readStreamFile reads file with the query of a file stream, with the macros expanded up to the
+// current time.
+func (d *SQLDataSourceWrapper) readStreamFile(ctx context.Context, query *sqlutil.Query, file string) (*data.Frame, error) {
+	q := *query
+	q.RawSQL = fileStreamQuery(q.RawSQL, file)
+	q.TimeRange.To = time.Now()
+	rawSQL, err := sqlutil.Interpolate(&q, d.driver.Macros())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", "Could not apply macros", err)
+	}
+	q.RawSQL = rawSQL
+	return d.runQuery(ctx, &q)
+}
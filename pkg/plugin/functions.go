@@ -0,0 +1,217 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/duckdb/duckdb-go/v2"
+)
+
+// functionCatalogTTL is how long the function catalog of a datasource is served from memory.
+// Functions change when queries load extensions or create macros, which is rare enough.
+const functionCatalogTTL = 5 * time.Minute
+
+// builtinFunctionsTimeout bounds the listing of the builtin functions, which does not depend on
+// the request that triggers it.
+const builtinFunctionsTimeout = 10 * time.Second
+
+const (
+	functionSourceBuiltin   = "builtin"
+	functionSourceExtension = "extension"
+	functionSourceUser      = "user"
+)
+
+// catalogFunction is an overload of a function listed by the /functions resource.
+type catalogFunction struct {
+	Name        string              `json:"name"`
+	Type        string              `json:"type"`
+	Parameters  []functionParameter `json:"parameters"`
+	Varargs     string              `json:"varargs,omitempty"`
+	ReturnType  string              `json:"returnType,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Examples    []string            `json:"examples,omitempty"`
+	AliasOf     string              `json:"aliasOf,omitempty"`
+	// Source is builtin for the functions of DuckDB and the extensions bundled with it, extension
+	// for the functions of extensions loaded later and user for macros and user-defined functions.
+	Source   string `json:"source"`
+	Database string `json:"database,omitempty"`
+	Schema   string `json:"schema,omitempty"`
+}
+
+type functionParameter struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+// functionCatalog caches the encoded function catalog of a datasource. generation counts the
+// purges, a catalog listed before a purge is not cached.
+type functionCatalog struct {
+	mu         sync.Mutex
+	body       []byte
+	expires    time.Time
+	generation uint64
+}
+
+// Purge drops the cached catalog, for when the database is reopened.
+func (c *functionCatalog) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.body = nil
+	c.generation++
+}
+
+// get returns the cached catalog, or nil when it expired, and the generation a catalog listed now
+// is to be set with.
+func (c *functionCatalog) get() ([]byte, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().After(c.expires) {
+		return nil, c.generation
+	}
+	return c.body, c.generation
+}
+
+// set caches body, unless the catalog was purged since generation was returned by get.
+func (c *functionCatalog) set(body []byte, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.body, c.expires = body, time.Now().Add(functionCatalogTTL)
+}
+
+// builtinFunctions holds the names of the functions of a database without any extension loaded
+// but the bundled ones. DuckDB does not record which extension registered a function, so the
+// functions missing from it are attributed to extensions loaded since. The names are listed on
+// first use, and again on the next use when the listing failed.
+var builtinFunctions struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+func loadBuiltinFunctions() (map[string]bool, error) {
+	builtinFunctions.mu.Lock()
+	defer builtinFunctions.mu.Unlock()
+	if builtinFunctions.names != nil {
+		return builtinFunctions.names, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), builtinFunctionsTimeout)
+	defer cancel()
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT function_name FROM duckdb_functions() WHERE internal")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	builtinFunctions.names = names
+	return names, nil
+}
+
+// handleFunctions lists the functions, macros and table functions available on the connection,
+// one entry per overload, for signature help and completion in the editor. The catalog is not
+// locked while it is listed, so a request cancelled during the listing does not hold up the
+// others; requests arriving in the meantime list it too.
+func (d *SQLDataSourceWrapper) handleFunctions(rw http.ResponseWriter, req *http.Request) {
+	body, generation := d.functions.get()
+	if body == nil {
+		functions, err := d.listFunctions(req.Context())
+		if err != nil {
+			sendResourceError(rw, http.StatusInternalServerError, err)
+			return
+		}
+		body, err = json.Marshal(map[string]any{"functions": functions})
+		if err != nil {
+			sendResourceError(rw, http.StatusInternalServerError, err)
+			return
+		}
+		d.functions.set(body, generation)
+	}
+	rw.Header().Add("Content-Type", "application/json")
+	if _, err := rw.Write(body); err != nil {
+		sendResourceError(rw, http.StatusInternalServerError, err)
+	}
+}
+
+func (d *SQLDataSourceWrapper) listFunctions(ctx context.Context) ([]catalogFunction, error) {
+	builtin, err := loadBuiltinFunctions()
+	if err != nil {
+		return nil, err
+	}
+	functions := []catalogFunction{}
+	err = d.queryResource(ctx, `
+		SELECT function_name, function_type, to_json(coalesce(parameters, []))::VARCHAR,
+			to_json(coalesce(parameter_types, []))::VARCHAR, varargs, return_type, description,
+			to_json(coalesce(examples, []))::VARCHAR, alias_of, internal, database_name, schema_name
+		FROM duckdb_functions()
+		WHERE function_type <> 'pragma' AND function_name NOT LIKE '\_\_%' ESCAPE '\'
+		ORDER BY function_name, function_type, function_oid`, nil, func(rows *sql.Rows) error {
+		var (
+			function                                catalogFunction
+			parameters, types, examples             string
+			varargs, returnType, description, alias sql.NullString
+			internal                                bool
+		)
+		if err := rows.Scan(&function.Name, &function.Type, &parameters, &types, &varargs, &returnType, &description,
+			&examples, &alias, &internal, &function.Database, &function.Schema); err != nil {
+			return err
+		}
+		function.Varargs, function.ReturnType = varargs.String, returnType.String
+		function.Description, function.AliasOf = description.String, alias.String
+
+		var names, typeNames []string
+		if err := json.Unmarshal([]byte(parameters), &names); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(types), &typeNames); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(examples), &function.Examples); err != nil {
+			return err
+		}
+		function.Parameters = make([]functionParameter, len(names))
+		for i, name := range names {
+			function.Parameters[i].Name = name
+			if i < len(typeNames) {
+				function.Parameters[i].Type = typeNames[i]
+			}
+		}
+
+		switch {
+		case !internal:
+			function.Source = functionSourceUser
+		case builtin[function.Name]:
+			function.Source = functionSourceBuiltin
+		default:
+			function.Source = functionSourceExtension
+		}
+		if internal {
+			// Every internal function lives in system.main.
+			function.Database, function.Schema = "", ""
+		}
+		functions = append(functions, function)
+		return nil
+	})
+	return functions, err
+}
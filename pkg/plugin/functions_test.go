@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestFunctions(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "initSql": "CREATE MACRO add_one(x) AS x + 1;"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	functions := func() map[string][]catalogFunction {
+		t.Helper()
+		resp := callResource(t, ds, "functions", nil)
+		if resp.Status != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", resp.Status, resp.Body)
+		}
+		var catalog struct {
+			Functions []catalogFunction `json:"functions"`
+		}
+		if err := json.Unmarshal(resp.Body, &catalog); err != nil {
+			t.Fatal(err)
+		}
+		byName := map[string][]catalogFunction{}
+		for _, function := range catalog.Functions {
+			byName[function.Name] = append(byName[function.Name], function)
+		}
+		return byName
+	}
+
+	byName := functions()
+	expected := []catalogFunction{{
+		Name:       "add_one",
+		Type:       "macro",
+		Parameters: []functionParameter{{Name: "x"}},
+		Source:     functionSourceUser,
+		Database:   "memory",
+		Schema:     "main",
+	}}
+	if !reflect.DeepEqual(byName["add_one"], expected) {
+		t.Errorf("expected %+v, got %+v", expected, byName["add_one"])
+	}
+	if len(byName["strftime"]) < 2 {
+		t.Fatalf("expected the overloads of strftime, got %+v", byName["strftime"])
+	}
+	for _, overload := range byName["strftime"] {
+		if overload.Source != functionSourceBuiltin || overload.ReturnType != "VARCHAR" || len(overload.Parameters) != 2 || overload.Parameters[0].Type == "" {
+			t.Errorf("expected a builtin overload with typed parameters, got %+v", overload)
+		}
+	}
+	if len(byName["read_csv"]) == 0 {
+		t.Error("expected table functions to be listed")
+	}
+
+	// The catalog is cached by the datasource, macros created since are listed once it expires.
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(`{"rawSql": "CREATE MACRO add_two(x) AS x + 2"}`)}},
+	})
+	if err != nil || resp.Responses["A"].Error != nil {
+		t.Fatal(err, resp.Responses["A"].Error)
+	}
+	if _, ok := functions()["add_two"]; ok {
+		t.Error("expected the cached catalog")
+	}
+	ds.functions.Purge()
+	if _, ok := functions()["add_two"]; !ok {
+		t.Error("expected the macro created by the query once the catalog is refreshed")
+	}
+}
+
+func TestFunctionsAfterCancelledRequest(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: []byte(`{"path":""}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	builtinFunctions.mu.Lock()
+	builtinFunctions.names = nil
+	builtinFunctions.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var cancelled *backend.CallResourceResponse
+	err = ds.CallResource(ctx, &backend.CallResourceRequest{Path: "functions", Method: http.MethodPost},
+		backend.CallResourceResponseSenderFunc(func(r *backend.CallResourceResponse) error {
+			cancelled = r
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.Status == http.StatusOK {
+		t.Fatalf("expected the cancelled request to fail, got %s", cancelled.Body)
+	}
+
+	resp := callResource(t, ds, "functions", nil)
+	if resp.Status != http.StatusOK {
+		t.Fatalf("expected the next request to list the functions, got %d: %s", resp.Status, resp.Body)
+	}
+	var catalog struct {
+		Functions []catalogFunction `json:"functions"`
+	}
+	if err := json.Unmarshal(resp.Body, &catalog); err != nil || len(catalog.Functions) == 0 {
+		t.Errorf("expected the functions, got %s", resp.Body)
+	}
+}
+
+func TestFunctionCatalogPurgedWhileListing(t *testing.T) {
+	var catalog functionCatalog
+	body, generation := catalog.get()
+	if body != nil {
+		t.Fatalf("expected no cached catalog, got %s", body)
+	}
+	// The database is reopened while the catalog of the previous one is listed.
+	catalog.Purge()
+	catalog.set([]byte(`{"functions":[]}`), generation)
+	if body, _ := catalog.get(); body != nil {
+		t.Errorf("expected the catalog listed before the purge not to be cached, got %s", body)
+	}
+
+	body, generation = catalog.get()
+	catalog.set([]byte(`{"functions":[]}`), generation)
+	if body, _ = catalog.get(); body == nil {
+		t.Error("expected the catalog listed after the purge to be cached")
+	}
+}
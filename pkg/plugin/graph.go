@@ -0,0 +1,255 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// flameStackSeparator separates the frames of a stack given as text, as in the folded stack
+// format with the root first.
+const flameStackSeparator = ";"
+
+// mappedField returns the index of the column a field of a graph format is read from: the column
+// the query maps the field to in columns, or else the first column named like the field or one of
+// names. It returns -1 when there is no such column.
+func mappedField(frame *data.Frame, columns map[string]string, field string, names ...string) (int, error) {
+	if column, ok := columns[field]; ok {
+		for i, f := range frame.Fields {
+			if f.Name == column {
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("the column %q mapped to %s is not in the result", column, field)
+	}
+	return findField(frame, append([]string{field}, names...), nil), nil
+}
+
+// formatNodeGraph converts a table of edges, one row per source and target pair, into the nodes
+// and edges frames of the node graph panel. The nodes are the distinct sources and targets; rows
+// without a target add their source as a node without edges. Columns other than the source,
+// target and stats are shown as details of the edges.
+func formatNodeGraph(frame *data.Frame, columns map[string]string) (data.Frames, error) {
+	sourceIdx, err := mappedField(frame, columns, "source")
+	if err != nil {
+		return nil, err
+	}
+	targetIdx, err := mappedField(frame, columns, "target")
+	if err != nil {
+		return nil, err
+	}
+	if sourceIdx < 0 || targetIdx < 0 {
+		return nil, fmt.Errorf("the node graph format requires a source and a target column")
+	}
+	mainStatIdx, err := mappedField(frame, columns, "mainStat")
+	if err != nil {
+		return nil, err
+	}
+	secondaryStatIdx, err := mappedField(frame, columns, "secondaryStat")
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		nodeIDs []string
+		seen    = map[string]bool{}
+		rows    []int
+		edgeIDs []string
+		sources []string
+		targets []string
+	)
+	addNode := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			nodeIDs = append(nodeIDs, id)
+		}
+	}
+	for i := 0; i < frame.Rows(); i++ {
+		if _, ok := frame.Fields[sourceIdx].ConcreteAt(i); !ok {
+			continue
+		}
+		source := stringValue(frame.Fields[sourceIdx], i)
+		addNode(source)
+		if _, ok := frame.Fields[targetIdx].ConcreteAt(i); !ok {
+			continue
+		}
+		target := stringValue(frame.Fields[targetIdx], i)
+		addNode(target)
+		rows = append(rows, i)
+		edgeIDs = append(edgeIDs, fmt.Sprintf("%s->%s#%d", source, target, len(edgeIDs)))
+		sources = append(sources, source)
+		targets = append(targets, target)
+	}
+
+	nodes := data.NewFrame("nodes",
+		data.NewField("id", nil, nodeIDs),
+		data.NewField("title", nil, nodeIDs),
+	)
+	edges := data.NewFrame("edges",
+		data.NewField("id", nil, edgeIDs),
+		data.NewField("source", nil, sources),
+		data.NewField("target", nil, targets),
+	)
+	for i, field := range frame.Fields {
+		switch i {
+		case sourceIdx, targetIdx:
+		case mainStatIdx:
+			edges.Fields = append(edges.Fields, copyRows(field, rows, "mainstat"))
+		case secondaryStatIdx:
+			edges.Fields = append(edges.Fields, copyRows(field, rows, "secondarystat"))
+		default:
+			detail := copyRows(field, rows, "detail__"+field.Name)
+			detail.Config = &data.FieldConfig{DisplayName: field.Name}
+			edges.Fields = append(edges.Fields, detail)
+		}
+	}
+
+	for _, graph := range []*data.Frame{nodes, edges} {
+		graph.RefID = frame.RefID
+		meta := data.FrameMeta{}
+		if frame.Meta != nil {
+			meta = *frame.Meta
+		}
+		meta.PreferredVisualization = data.VisTypeNodeGraph
+		graph.Meta = &meta
+	}
+	return data.Frames{nodes, edges}, nil
+}
+
+// copyRows returns a field named name with the values of field at rows.
+func copyRows(field *data.Field, rows []int, name string) *data.Field {
+	copied := data.NewFieldFromFieldType(field.Type(), len(rows))
+	copied.Name = name
+	for i, row := range rows {
+		copied.Set(i, field.At(row))
+	}
+	return copied
+}
+
+type flameNode struct {
+	label    string
+	value    float64
+	self     float64
+	children map[string]*flameNode
+}
+
+// formatFlameGraph folds a table of stacks and their sample values into the nested set frame of
+// the flame graph panel: one row per node in depth-first order, with its level, total value, self
+// value and label, below a root node named total. Stacks are lists of frames or text with the
+// frames separated by flameStackSeparator, root first.
+func formatFlameGraph(frame *data.Frame, columns map[string]string) (*data.Frame, error) {
+	stackIdx, err := mappedField(frame, columns, "stack")
+	if err != nil {
+		return nil, err
+	}
+	valueIdx, err := mappedField(frame, columns, "value", "samples")
+	if err != nil {
+		return nil, err
+	}
+	if stackIdx < 0 || valueIdx < 0 {
+		return nil, fmt.Errorf("the flame graph format requires a stack and a value column")
+	}
+	if !frame.Fields[valueIdx].Type().Numeric() {
+		return nil, fmt.Errorf("the value column of the flame graph format must be a number, got %s", frame.Fields[valueIdx].Type().ItemTypeString())
+	}
+
+	root := &flameNode{label: "total"}
+	for i := 0; i < frame.Rows(); i++ {
+		if _, ok := frame.Fields[valueIdx].ConcreteAt(i); !ok {
+			continue
+		}
+		value, _ := frame.Fields[valueIdx].FloatAt(i)
+		stack, err := stackFrames(frame.Fields[stackIdx], i)
+		if err != nil {
+			return nil, fmt.Errorf("the stack of row %d: %w", i+1, err)
+		}
+
+		node := root
+		node.value += value
+		for _, label := range stack {
+			child, ok := node.children[label]
+			if !ok {
+				if node.children == nil {
+					node.children = map[string]*flameNode{}
+				}
+				child = &flameNode{label: label}
+				node.children[label] = child
+			}
+			child.value += value
+			node = child
+		}
+		node.self += value
+	}
+
+	var (
+		levels []int64
+		values []float64
+		selfs  []float64
+		labels []string
+	)
+	var walk func(node *flameNode, level int64)
+	walk = func(node *flameNode, level int64) {
+		levels = append(levels, level)
+		values = append(values, node.value)
+		selfs = append(selfs, node.self)
+		labels = append(labels, node.label)
+		names := make([]string, 0, len(node.children))
+		for name := range node.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			walk(node.children[name], level+1)
+		}
+	}
+	walk(root, 0)
+
+	flame := data.NewFrame(frame.Name,
+		data.NewField("level", nil, levels),
+		data.NewField("value", nil, values),
+		data.NewField("self", nil, selfs),
+		data.NewField("label", nil, labels),
+	)
+	flame.RefID = frame.RefID
+	meta := data.FrameMeta{}
+	if frame.Meta != nil {
+		meta = *frame.Meta
+	}
+	meta.PreferredVisualization = data.VisTypeFlameGraph
+	flame.Meta = &meta
+	return flame, nil
+}
+
+// stackFrames returns the frames of the stack at row i of field, root first.
+func stackFrames(field *data.Field, i int) ([]string, error) {
+	v, ok := field.ConcreteAt(i)
+	if !ok {
+		return nil, nil
+	}
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		return strings.Split(v, flameStackSeparator), nil
+	case json.RawMessage:
+		var stack []any
+		if err := json.Unmarshal(v, &stack); err != nil {
+			return nil, fmt.Errorf("expected a list of frames")
+		}
+		frames := make([]string, len(stack))
+		for j, frame := range stack {
+			if s, ok := frame.(string); ok {
+				frames[j] = s
+			} else {
+				encoded, _ := json.Marshal(frame)
+				frames[j] = string(encoded)
+			}
+		}
+		return frames, nil
+	}
+	return nil, fmt.Errorf("expected text or a list of frames, got %s", field.Type().ItemTypeString())
+}
@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+func graphTestQuery(t *testing.T, ds *SQLDataSourceWrapper, model map[string]any) backend.DataResponse {
+	t.Helper()
+	encoded, _ := json.Marshal(model)
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: encoded}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Responses["A"]
+}
+
+func TestNodeGraphFormat(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: []byte(`{"path":""}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := graphTestQuery(t, ds, map[string]any{
+		"rawSql":  "SELECT * FROM (VALUES ('web', 'api', 120, 'http'), ('api', 'db', 80, 'sql'), ('cron', NULL, 0, NULL)) t(caller, callee, requests, protocol)",
+		"format":  models.FormatOptionNodeGraph,
+		"columns": map[string]string{"source": "caller", "target": "callee", "mainStat": "requests"},
+	})
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if len(resp.Frames) != 2 || resp.Frames[0].Name != "nodes" || resp.Frames[1].Name != "edges" {
+		t.Fatalf("expected a nodes and an edges frame, got %v", resp.Frames)
+	}
+	nodes, edges := resp.Frames[0], resp.Frames[1]
+	var ids []string
+	for i := 0; i < nodes.Rows(); i++ {
+		ids = append(ids, nodes.Fields[0].At(i).(string))
+	}
+	if !reflect.DeepEqual(ids, []string{"web", "api", "db", "cron"}) {
+		t.Errorf("unexpected nodes %v", ids)
+	}
+	if edges.Rows() != 2 || edges.Meta.PreferredVisualization != data.VisTypeNodeGraph {
+		t.Fatalf("expected 2 node graph edges, got %d", edges.Rows())
+	}
+	if f, _ := edges.FieldByName("target"); f.At(1) != "db" {
+		t.Errorf("expected the second edge to target db, got %v", f.At(1))
+	}
+	if f, _ := edges.FieldByName("mainstat"); f == nil || *f.At(0).(*int32) != 120 {
+		t.Errorf("expected the requests column as main stat")
+	}
+	if f, _ := edges.FieldByName("detail__protocol"); f == nil || f.Config.DisplayName != "protocol" {
+		t.Errorf("expected the protocol column as edge detail")
+	}
+
+	resp = graphTestQuery(t, ds, map[string]any{
+		"rawSql":  "SELECT 'a' AS source, 'b' AS target",
+		"format":  models.FormatOptionNodeGraph,
+		"columns": map[string]string{"mainStat": "calls"},
+	})
+	if resp.Error == nil || !strings.Contains(resp.Error.Error(), `"calls"`) {
+		t.Errorf("expected a missing mapped column to be rejected, got %v", resp.Error)
+	}
+}
+
+func TestFlameGraphFormat(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: []byte(`{"path":""}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		level       int64
+		value, self float64
+		label       string
+	}{
+		{0, 10, 0, "total"},
+		{1, 10, 1, "main"},
+		{2, 6, 2, "handle"},
+		{3, 4, 4, "query"},
+		{2, 3, 3, "render"},
+	}
+	for _, query := range []map[string]any{
+		{"rawSql": "SELECT * FROM (VALUES ('main;handle;query', 4), ('main;handle', 2), ('main;render', 3), ('main', 1)) t(stack, samples)"},
+		{
+			"rawSql":  "SELECT * FROM (VALUES (['main', 'handle', 'query'], 4), (['main', 'handle'], 2), (['main', 'render'], 3), (['main'], 1)) t(frames, samples)",
+			"columns": map[string]string{"stack": "frames"},
+		},
+	} {
+		query["format"] = models.FormatOptionFlameGraph
+		resp := graphTestQuery(t, ds, query)
+		if resp.Error != nil {
+			t.Fatal(resp.Error)
+		}
+		frame := resp.Frames[0]
+		if frame.Meta.PreferredVisualization != data.VisTypeFlameGraph || frame.Rows() != len(want) {
+			t.Fatalf("expected a flame graph of %d rows, got %d", len(want), frame.Rows())
+		}
+		for i, w := range want {
+			if frame.Fields[0].At(i) != w.level || frame.Fields[1].At(i) != w.value || frame.Fields[2].At(i) != w.self || frame.Fields[3].At(i) != w.label {
+				t.Errorf("row %d: expected %v, got %v %v %v %v", i, w, frame.Fields[0].At(i), frame.Fields[1].At(i), frame.Fields[2].At(i), frame.Fields[3].At(i))
+			}
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+// macroHistogram expands $__histogram(column, [bound, ...]), $__histogram(column, buckets) and
+// $__histogram(column, buckets, min, max) to a MAP from bucket upper bounds to the number of
+// values of column up to each bound, like DuckDB's histogram aggregate. Given a bucket count, the
+// bounds split [min, max] into buckets of equal width, by default the min and max of column over
+// the whole result. Values above the last bound are counted in a "+Inf" bucket.
+func macroHistogram(query *sqlutil.Query, args []string) (string, error) {
+	args = macroArguments(query.RawSQL, "histogram", args)
+	if len(args) < 2 || args[0] == "" {
+		return "", fmt.Errorf("%w: expected a column and the buckets", sqlutil.ErrorBadArgumentCount)
+	}
+	column := args[0]
+	if strings.HasPrefix(args[1], "[") && len(args) == 2 {
+		return histogramWithOverflow(column, args[1]), nil
+	}
+	if len(args) != 2 && len(args) != 4 {
+		return "", fmt.Errorf("%w: expected a list of bounds, or a bucket count with optionally the min and max of the values", sqlutil.ErrorBadArgumentCount)
+	}
+	buckets, err := strconv.Atoi(args[1])
+	if err != nil || buckets <= 0 {
+		return "", fmt.Errorf("the bucket count of $__histogram must be a positive integer, got %q", args[1])
+	}
+	if len(args) == 4 {
+		return histogramWithOverflow(column, fmt.Sprintf("equi_width_bins(%s, %s, %d, false)", args[2], args[3], buckets)), nil
+	}
+	// The bounds depend on every row of the result, which aggregates cannot read: the values of
+	// each group are listed and counted once the min and max are known. The last bound is the max,
+	// so there is no overflow bucket.
+	return fmt.Sprintf("list_transform([{'bounds': equi_width_bins(min(min(%[1]s)) OVER (), max(max(%[1]s)) OVER (), %[2]d, false), 'values': list(%[1]s)}], "+
+		"h -> map_from_entries([{'key': h.bounds[i]::VARCHAR, 'value': len([v FOR v IN h.values IF v <= h.bounds[i] AND (i = 1 OR v > h.bounds[i - 1])])} "+
+		"FOR i IN range(1, len(h.bounds) + 1)]))[1]", column, buckets), nil
+}
+
+// histogramWithOverflow returns DuckDB's histogram aggregate of column over bounds, with the key of
+// the bucket of values above the last bound, the largest value of the type of column, renamed to
+// "+Inf".
+func histogramWithOverflow(column, bounds string) string {
+	return fmt.Sprintf("map_from_entries([{'key': CASE WHEN bucket.key > list_max(%[2]s) THEN '+Inf' ELSE bucket.key::VARCHAR END, 'value': bucket.value} "+
+		"FOR bucket IN map_entries(histogram(%[1]s, %[2]s))])", column, bounds)
+}
+
+// macroArguments returns the arguments of the first call of the macro name in text that sqlutil
+// parsed as args, split at the commas outside of parentheses, brackets, braces and quotes.
+// sqlutil only balances parentheses, so it splits lists like [10, 50] and strings like 'a,b'.
+func macroArguments(text, name string, args []string) []string {
+	joined := strings.Join(args, ",")
+	call := "$__" + name + "("
+	for pos := strings.Index(text, call); pos >= 0; {
+		start := pos + len(call) - 1
+		length := macroArgsLength(text[start:])
+		if length < 0 {
+			break
+		}
+		raw := text[start+1 : start+length-1]
+		if removeSpaces(raw) == removeSpaces(joined) {
+			return splitArguments(raw)
+		}
+		next := strings.Index(text[start:], call)
+		if next < 0 {
+			break
+		}
+		pos = start + next
+	}
+	return splitArguments(joined)
+}
+
+func removeSpaces(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+// splitArguments splits the arguments of a function call at the commas outside of parentheses,
+// brackets, braces and quotes, and trims them.
+func splitArguments(s string) []string {
+	var args []string
+	depth, start := 0, 0
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '(' || r == '[' || r == '{':
+			depth++
+		case r == ')' || r == ']' || r == '}':
+			depth--
+		case r == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
+
+// frameTypeHeatmapCells is the type of frames the heatmap panel reads as cells, which the SDK has
+// no constant for.
+const frameTypeHeatmapCells data.FrameType = "heatmap-cells"
+
+type heatmapCell struct {
+	x     time.Time
+	y     float64
+	count float64
+}
+
+// formatHeatmap converts histograms into the heatmap cells frame of the heatmap panel, with one
+// cell per time and bucket upper bound. The histograms are read from, in order of preference:
+//   - a MAP column from bucket upper bounds to counts, as returned by DuckDB's histogram aggregate,
+//   - rows with a bucket upper bound column and a count column,
+//   - count columns named after the bucket upper bound, like "10", "50" and "+Inf".
+func formatHeatmap(frame *data.Frame, columns map[string]string) (*data.Frame, error) {
+	timeIdx, err := mappedField(frame, columns, "time")
+	if err != nil {
+		return nil, err
+	}
+	if timeIdx < 0 {
+		timeIdx = firstUnused(frame, nil, isTimeField)
+	}
+	if timeIdx < 0 || !frame.Fields[timeIdx].Type().Time() {
+		return nil, fmt.Errorf("the heatmap format requires a time column")
+	}
+
+	var cells []heatmapCell
+	histogramIdx, err := mappedField(frame, columns, "histogram")
+	if err != nil {
+		return nil, err
+	}
+	if histogramIdx < 0 {
+		histogramIdx = firstUnused(frame, nil, func(field *data.Field) bool {
+			return field.Type() == data.FieldTypeJSON || field.Type() == data.FieldTypeNullableJSON
+		})
+	}
+	bucketIdx, err := mappedField(frame, columns, "bucket", "le", "yMax")
+	if err != nil {
+		return nil, err
+	}
+	countIdx, err := mappedField(frame, columns, "count")
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case histogramIdx >= 0:
+		for i := 0; i < frame.Rows(); i++ {
+			x, ok := timeValue(frame.Fields[timeIdx].At(i))
+			if !ok {
+				continue
+			}
+			v, ok := frame.Fields[histogramIdx].ConcreteAt(i)
+			if !ok {
+				continue
+			}
+			var histogram map[string]float64
+			if err := json.Unmarshal(v.(json.RawMessage), &histogram); err != nil {
+				return nil, fmt.Errorf("the histogram of row %d must map bucket upper bounds to counts", i+1)
+			}
+			for bound, count := range histogram {
+				y, err := parseBucketBound(bound)
+				if err != nil {
+					return nil, fmt.Errorf("the histogram of row %d: %w", i+1, err)
+				}
+				cells = append(cells, heatmapCell{x: x, y: y, count: count})
+			}
+		}
+	case bucketIdx >= 0 && countIdx >= 0:
+		if !frame.Fields[countIdx].Type().Numeric() {
+			return nil, fmt.Errorf("the count column of the heatmap format must be a number, got %s", frame.Fields[countIdx].Type().ItemTypeString())
+		}
+		for i := 0; i < frame.Rows(); i++ {
+			x, ok := timeValue(frame.Fields[timeIdx].At(i))
+			if !ok {
+				continue
+			}
+			if _, ok := frame.Fields[bucketIdx].ConcreteAt(i); !ok {
+				continue
+			}
+			y, err := parseBucketBound(stringValue(frame.Fields[bucketIdx], i))
+			if err != nil {
+				return nil, fmt.Errorf("the bucket of row %d: %w", i+1, err)
+			}
+			count, _ := frame.Fields[countIdx].FloatAt(i)
+			if math.IsNaN(count) {
+				continue
+			}
+			cells = append(cells, heatmapCell{x: x, y: y, count: count})
+		}
+	default:
+		buckets := map[int]float64{}
+		for j, field := range frame.Fields {
+			if j == timeIdx || !field.Type().Numeric() {
+				continue
+			}
+			if y, err := parseBucketBound(field.Name); err == nil {
+				buckets[j] = y
+			}
+		}
+		if len(buckets) == 0 {
+			return nil, fmt.Errorf("the heatmap format requires a histogram MAP column, bucket and count columns, or count columns named after the bucket upper bounds")
+		}
+		for i := 0; i < frame.Rows(); i++ {
+			x, ok := timeValue(frame.Fields[timeIdx].At(i))
+			if !ok {
+				continue
+			}
+			for j, y := range buckets {
+				count, _ := frame.Fields[j].FloatAt(i)
+				if math.IsNaN(count) {
+					continue
+				}
+				cells = append(cells, heatmapCell{x: x, y: y, count: count})
+			}
+		}
+	}
+
+	sort.Slice(cells, func(i, j int) bool {
+		if !cells[i].x.Equal(cells[j].x) {
+			return cells[i].x.Before(cells[j].x)
+		}
+		return cells[i].y < cells[j].y
+	})
+	xs := make([]time.Time, len(cells))
+	ys := make([]float64, len(cells))
+	counts := make([]float64, len(cells))
+	for i, cell := range cells {
+		xs[i], ys[i], counts[i] = cell.x, cell.y, cell.count
+	}
+
+	heatmap := data.NewFrame(frame.Name,
+		data.NewField("xMin", nil, xs),
+		data.NewField("yMax", nil, ys),
+		data.NewField("count", nil, counts),
+	)
+	heatmap.RefID = frame.RefID
+	meta := data.FrameMeta{}
+	if frame.Meta != nil {
+		meta = *frame.Meta
+	}
+	meta.Type = frameTypeHeatmapCells
+	heatmap.Meta = &meta
+	return heatmap, nil
+}
+
+// parseBucketBound parses the upper bound of a histogram bucket, such as "10", "0.5" or "+Inf".
+func parseBucketBound(bound string) (float64, error) {
+	y, err := strconv.ParseFloat(strings.TrimSpace(bound), 64)
+	if err != nil || math.IsNaN(y) {
+		return 0, fmt.Errorf("the bucket upper bound %q is not a number", bound)
+	}
+	return y, nil
+}
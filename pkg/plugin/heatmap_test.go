@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+func TestMacroHistogram(t *testing.T) {
+	for _, tc := range []struct {
+		sql, want string
+	}{
+		{"$__histogram(latency, [10, 50, 100])", "map_from_entries([{'key': CASE WHEN bucket.key > list_max([10, 50, 100]) THEN '+Inf' ELSE bucket.key::VARCHAR END, 'value': bucket.value} FOR bucket IN map_entries(histogram(latency, [10, 50, 100]))])"},
+		{"$__histogram(latency, 4, 0, 100)", "map_from_entries([{'key': CASE WHEN bucket.key > list_max(equi_width_bins(0, 100, 4, false)) THEN '+Inf' ELSE bucket.key::VARCHAR END, 'value': bucket.value} FOR bucket IN map_entries(histogram(latency, equi_width_bins(0, 100, 4, false)))])"},
+		{"$__histogram(coalesce(latency, 0), 4)", "list_transform([{'bounds': equi_width_bins(min(min(coalesce(latency, 0))) OVER (), max(max(coalesce(latency, 0))) OVER (), 4, false), 'values': list(coalesce(latency, 0))}], " +
+			"h -> map_from_entries([{'key': h.bounds[i]::VARCHAR, 'value': len([v FOR v IN h.values IF v <= h.bounds[i] AND (i = 1 OR v > h.bounds[i - 1])])} FOR i IN range(1, len(h.bounds) + 1)]))[1]"},
+	} {
+		got, err := sqlutil.Interpolate(&sqlutil.Query{RawSQL: tc.sql}, (&DuckDBDriver{}).Macros())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("expected %s to expand to %s, got %s", tc.sql, tc.want, got)
+		}
+	}
+	for _, sql := range []string{"$__histogram(latency)", "$__histogram(latency, 0)", "$__histogram(latency, -1, 0, 100)", "$__histogram(latency, 4, 0)"} {
+		if _, err := sqlutil.Interpolate(&sqlutil.Query{RawSQL: sql}, (&DuckDBDriver{}).Macros()); err == nil {
+			t.Errorf("expected %s to be rejected", sql)
+		}
+	}
+}
+
+func TestSplitArguments(t *testing.T) {
+	for text, want := range map[string][]string{
+		"latency, [10, 50]":              {"latency", "[10, 50]"},
+		"coalesce(a, b), 4":              {"coalesce(a, b)", "4"},
+		"CASE WHEN s = 'a,b' THEN 1 END": {"CASE WHEN s = 'a,b' THEN 1 END"},
+		`"x,y", {'k': 1, 'l': 2}`:        {`"x,y"`, "{'k': 1, 'l': 2}"},
+	} {
+		if got := splitArguments(text); !slices.Equal(got, want) {
+			t.Errorf("expected %s to split into %q, got %q", text, want, got)
+		}
+	}
+}
+
+func TestHeatmapFormat(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "initSql": "CREATE TABLE requests AS SELECT TIMESTAMP '2024-01-01' + to_minutes(i // 10) AS ts, (i % 10) * 20 AS latency FROM range(0, 20) t(i);"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type cell struct {
+		y     float64
+		count float64
+	}
+	// Each minute has the latencies 0, 20, ..., 180.
+	buckets := []cell{{50, 3}, {100, 3}, {math.Inf(1), 4}}
+	for _, tc := range []struct {
+		name, sql string
+		want      []cell
+	}{
+		{"map", "SELECT ts AS time, $__histogram(latency, [50, 100]) AS latency FROM requests GROUP BY 1", buckets},
+		{"rows", "SELECT ts, CASE WHEN latency <= 50 THEN '50' WHEN latency <= 100 THEN '100' ELSE '+Inf' END AS le, count(*) AS count FROM requests GROUP BY ALL", buckets},
+		{"wide", `SELECT ts, count(*) FILTER (latency <= 50) AS "50", count(*) FILTER (latency > 50 AND latency <= 100) AS "100", count(*) FILTER (latency > 100) AS "+Inf" FROM requests GROUP BY 1`, buckets},
+		{"bound of the largest value of a type", "SELECT ts AS time, $__histogram(latency, [100, 255]) AS latency FROM requests GROUP BY 1", []cell{{100, 6}, {255, 4}}},
+		{"overflow past 255", "SELECT ts AS time, $__histogram(coalesce(latency, 0) * 2, [100, 255]) AS latency FROM requests GROUP BY 1", []cell{{100, 3}, {255, 4}, {math.Inf(1), 3}}},
+		{"bucket count", "SELECT ts AS time, $__histogram(latency, 3) AS latency FROM requests GROUP BY 1", []cell{{60, 4}, {120, 3}, {180, 3}}},
+	} {
+		encoded, _ := json.Marshal(map[string]any{"rawSql": tc.sql, "format": models.FormatOptionHeatmap})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: encoded}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Responses["A"].Error != nil {
+			t.Fatalf("%s: %v", tc.name, resp.Responses["A"].Error)
+		}
+		frame := resp.Responses["A"].Frames[0]
+		if frame.Meta.Type != frameTypeHeatmapCells || frame.Rows() != 2*len(tc.want) {
+			t.Fatalf("%s: expected %d heatmap cells, got %d", tc.name, 2*len(tc.want), frame.Rows())
+		}
+		for i := 0; i < frame.Rows(); i++ {
+			w := tc.want[i%len(tc.want)]
+			x := first.Add(time.Duration(i/len(tc.want)) * time.Minute)
+			if !frame.Fields[0].At(i).(time.Time).Equal(x) || frame.Fields[1].At(i) != w.y || frame.Fields[2].At(i) != w.count {
+				t.Errorf("%s: cell %d: expected %v %v %v, got %v %v %v", tc.name, i, x, w.y, w.count, frame.Fields[0].At(i), frame.Fields[1].At(i), frame.Fields[2].At(i))
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+// timeRangeMacros are the macros that restrict a query to the dashboard time range. A query must
+// use one of them to be run incrementally, otherwise querying the tail would return every row again.
+var timeRangeMacros = []string{"$__timeFilter", "$__timeFrom", "$__timeTo", "$__unixEpochFilter"}
+
+// incrementalCacheKey identifies an incremental query by its text with the time macros unexpanded,
+// so that refreshes of a rolling time range share their cached rows.
+func incrementalCacheKey(datasourceUID string, q *sqlutil.Query, args ...any) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00", datasourceUID, q.RefID, q.Format, q.Interval)
+	h.Write([]byte(q.RawSQL))
+	if len(args) > 0 {
+		fmt.Fprintf(h, "\x00%#v", args)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// runIncrementalQuery runs a time series query whose macros are not expanded yet, reusing rows
+// fetched by earlier runs of the same query. Only the tail of the time range that is not covered
+// by the cached rows is queried from DuckDB. The last interval of the cached rows is queried
+// again, as its bucket may have been incomplete when it was fetched.
+func (d *SQLDataSourceWrapper) runIncrementalQuery(ctx context.Context, template *sqlutil.Query) (*data.Frame, error) {
+	if !usesTimeRange(template.RawSQL) {
+		return nil, fmt.Errorf("incremental queries must filter on the time range with one of %s", strings.Join(timeRangeMacros, ", "))
+	}
+
+	key := incrementalCacheKey(d.settings.UID, template, queryArgs(ctx)...)
+	tr := template.TimeRange
+
+	tailFrom := tr.From
+	cached, span, ok := d.incremental.GetSpan(key)
+	if ok && len(cached) == 1 && !span.From.After(tr.From) && !span.To.After(tr.To) {
+		tailFrom = span.To.Add(-template.Interval)
+		if template.Interval > 0 {
+			tailFrom = tailFrom.Truncate(template.Interval)
+		}
+		if tailFrom.Before(tr.From) {
+			tailFrom = tr.From
+		}
+	}
+
+	frame, err := d.runTimeRange(ctx, template, tailFrom, tr.To)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := firstTimeField(frame); err != nil {
+		return nil, err
+	}
+
+	if tailFrom.After(tr.From) {
+		merged, err := mergeTail(cached[0], frame, tr.From, tailFrom)
+		if err == nil {
+			// Only the tail ran, its metadata (e.g. the query profile) describes this run.
+			merged.Meta = frame.Meta
+			frame = merged
+		} else {
+			backend.Logger.Debug("Could not reuse cached rows, querying the whole time range", "error", err)
+			frame, err = d.runTimeRange(ctx, template, tr.From, tr.To)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	d.incremental.SetSpan(key, data.Frames{frame}, tr)
+	return frame, nil
+}
+
+// runTimeRange expands the macros of template for the time range [from, to] and runs it.
+func (d *SQLDataSourceWrapper) runTimeRange(ctx context.Context, template *sqlutil.Query, from, to time.Time) (*data.Frame, error) {
+	q := *template
+	q.TimeRange = backend.TimeRange{From: from, To: to}
+	rawSQL, err := sqlutil.Interpolate(&q, d.driver.Macros())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", "Could not apply macros", err)
+	}
+	q.RawSQL = rawSQL
+	return d.runQuery(ctx, &q)
+}
+
+// mergeTail returns the rows of cached that fall in [from, tailFrom) followed by the rows of tail
+// from tailFrom on. Both frames must be results of the same query.
+func mergeTail(cached, tail *data.Frame, from, tailFrom time.Time) (*data.Frame, error) {
+	timeIdx, err := firstTimeField(cached)
+	if err != nil {
+		return nil, err
+	}
+	if len(cached.Fields) != len(tail.Fields) {
+		return nil, fmt.Errorf("cached rows have %d fields, tail has %d", len(cached.Fields), len(tail.Fields))
+	}
+	for i := range cached.Fields {
+		if cached.Fields[i].Name != tail.Fields[i].Name || cached.Fields[i].Type() != tail.Fields[i].Type() {
+			return nil, fmt.Errorf("field %q of cached rows does not match the tail", cached.Fields[i].Name)
+		}
+	}
+
+	merged, err := cached.FilterRowsByField(timeIdx, func(v interface{}) (bool, error) {
+		t, ok := timeValue(v)
+		return ok && !t.Before(from) && t.Before(tailFrom), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < tail.Rows(); i++ {
+		if t, ok := timeValue(tail.Fields[timeIdx].At(i)); ok && t.Before(tailFrom) {
+			continue
+		}
+		merged.AppendRow(tail.RowCopy(i)...)
+	}
+	return merged, nil
+}
+
+func firstTimeField(frame *data.Frame) (int, error) {
+	timeFields := frame.TypeIndices(data.FieldTypeTime, data.FieldTypeNullableTime)
+	if len(timeFields) == 0 {
+		return 0, fmt.Errorf("incremental queries must return a time column")
+	}
+	return timeFields[0], nil
+}
+
+func timeValue(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case *time.Time:
+		if t == nil {
+			return time.Time{}, false
+		}
+		return *t, true
+	}
+	return time.Time{}, false
+}
+
+func usesTimeRange(rawSQL string) bool {
+	for _, macro := range timeRangeMacros {
+		if strings.Contains(rawSQL, macro) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/sqlds/v3"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+const (
+	defaultLogContextLimit = 50
+	maxLogContextLimit     = 1000
+)
+
+// Columns are picked for the fields of a logs frame by these names, compared case-insensitively.
+var (
+	logTimestampColumns = []string{"timestamp", "time", "ts"}
+	logBodyColumns      = []string{"body", "message", "msg", "line", "log", "content"}
+	logSeverityColumns  = []string{"severity", "level", "lvl", "log_level", "loglevel"}
+	logIDColumns        = []string{"id"}
+)
+
+// logLevels maps the values of level columns to the levels Grafana knows. Numeric levels are
+// read as syslog severities.
+var logLevels = map[string]string{
+	"emerg": "critical", "emergency": "critical", "alert": "critical", "crit": "critical",
+	"critical": "critical", "fatal": "critical", "panic": "critical",
+	"0": "critical", "1": "critical", "2": "critical",
+	"e": "error", "err": "error", "eror": "error", "error": "error", "3": "error",
+	"w": "warning", "warn": "warning", "warning": "warning", "4": "warning",
+	"i": "info", "info": "info", "information": "info", "informational": "info", "notice": "info",
+	"5": "info", "6": "info",
+	"d": "debug", "dbug": "debug", "debug": "debug", "7": "debug",
+	"t": "trace", "trace": "trace",
+}
+
+// formatLogs converts a query result into a logs frame of the data plane contract: a timestamp,
+// a body, and optionally a severity and an id, with every other column folded into the labels.
+func formatLogs(frame *data.Frame) (*data.Frame, error) {
+	used := map[int]bool{}
+
+	timeIdx := findField(frame, logTimestampColumns, isTimeField)
+	if timeIdx < 0 {
+		timeIdx = firstUnused(frame, used, isTimeField)
+	}
+	if timeIdx < 0 {
+		return nil, fmt.Errorf("the logs format requires a time column")
+	}
+	used[timeIdx] = true
+	bodyIdx := findField(frame, logBodyColumns, isStringField)
+	if bodyIdx >= 0 {
+		used[bodyIdx] = true
+	} else if bodyIdx = firstUnused(frame, used, isStringField); bodyIdx >= 0 {
+		used[bodyIdx] = true
+	} else {
+		return nil, fmt.Errorf("the logs format requires a text column for the log line")
+	}
+	severityIdx := findField(frame, logSeverityColumns, nil)
+	if severityIdx >= 0 {
+		used[severityIdx] = true
+	}
+	idIdx := findField(frame, logIDColumns, nil)
+	if idIdx >= 0 {
+		used[idIdx] = true
+	}
+
+	var (
+		timestamps []time.Time
+		bodies     []string
+		severities []string
+		ids        []string
+		labels     []json.RawMessage
+	)
+	for i := 0; i < frame.Rows(); i++ {
+		ts, ok := timeValue(frame.Fields[timeIdx].At(i))
+		if !ok {
+			// The timestamp of a log line must not be null.
+			continue
+		}
+		timestamps = append(timestamps, ts)
+		bodies = append(bodies, stringValue(frame.Fields[bodyIdx], i))
+		if severityIdx >= 0 {
+			severities = append(severities, logLevel(stringValue(frame.Fields[severityIdx], i)))
+		}
+		if idIdx >= 0 {
+			ids = append(ids, stringValue(frame.Fields[idIdx], i))
+		} else {
+			ids = append(ids, strconv.FormatInt(ts.UnixNano(), 10)+"_"+strconv.Itoa(i))
+		}
+
+		rowLabels := map[string]string{}
+		for j, field := range frame.Fields {
+			if used[j] {
+				continue
+			}
+			if _, ok := field.ConcreteAt(i); ok {
+				rowLabels[field.Name] = stringValue(field, i)
+			}
+		}
+		encoded, err := json.Marshal(rowLabels)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, encoded)
+	}
+
+	logs := data.NewFrame(frame.Name,
+		data.NewField("timestamp", nil, timestamps),
+		data.NewField("body", nil, bodies),
+	)
+	if severityIdx >= 0 {
+		logs.Fields = append(logs.Fields, data.NewField("severity", nil, severities))
+	}
+	logs.Fields = append(logs.Fields,
+		data.NewField("id", nil, ids),
+		data.NewField("labels", nil, labels),
+	)
+	logs.RefID = frame.RefID
+
+	meta := data.FrameMeta{}
+	if frame.Meta != nil {
+		meta = *frame.Meta
+	}
+	meta.Type = data.FrameTypeLogLines
+	meta.TypeVersion = data.FrameTypeVersion{0, 0}
+	meta.PreferredVisualization = data.VisTypeLogs
+	logs.Meta = &meta
+	return logs, nil
+}
+
+func logLevel(level string) string {
+	if mapped, ok := logLevels[strings.ToLower(strings.TrimSpace(level))]; ok {
+		return mapped
+	}
+	return "unknown"
+}
+
+// findField returns the index of the first field of frame named like one of names and accepted
+// by match, or -1.
+func findField(frame *data.Frame, names []string, match func(*data.Field) bool) int {
+	for _, name := range names {
+		for i, field := range frame.Fields {
+			if strings.EqualFold(field.Name, name) && (match == nil || match(field)) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func firstUnused(frame *data.Frame, used map[int]bool, match func(*data.Field) bool) int {
+	for i, field := range frame.Fields {
+		if !used[i] && match(field) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isTimeField(field *data.Field) bool {
+	return field.Type().Time()
+}
+
+func isStringField(field *data.Field) bool {
+	return field.Type() == data.FieldTypeString || field.Type() == data.FieldTypeNullableString
+}
+
+func stringValue(field *data.Field, i int) string {
+	v, ok := field.ConcreteAt(i)
+	if !ok {
+		return ""
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case json.RawMessage:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// logContextTimeRange narrows the time range of a log context query to the rows before (or, going
+// forward, after) the log line the context is shown for.
+func logContextTimeRange(tr backend.TimeRange, logContext *models.LogContext) backend.TimeRange {
+	at := time.UnixMilli(logContext.Time)
+	if logContext.Direction == models.LogContextForward {
+		if at.After(tr.From) {
+			tr.From = at
+		}
+	} else if at.Before(tr.To) {
+		tr.To = at
+	}
+	return tr
+}
+
+// runLogContextQuery runs q restricted to the log lines closest to the log line at
+// logContext.Time, in the direction of the context.
+func (d *SQLDataSourceWrapper) runLogContextQuery(ctx context.Context, q *sqlutil.Query, logContext *models.LogContext) (*data.Frame, error) {
+	if err := requireSingleStatement(q.RawSQL, "log context"); err != nil {
+		return nil, err
+	}
+	inner := subquery(q.RawSQL)
+
+	describe := *q
+	describe.RawSQL = "DESCRIBE " + inner
+	columns, err := d.runQuery(ctx, &describe)
+	if err != nil {
+		return nil, err
+	}
+	timeColumn := logContextTimeColumn(columns)
+	if timeColumn == "" {
+		return nil, sqlds.DownstreamError(fmt.Errorf("%w: log context queries require a time column", sqlds.ErrorQuery))
+	}
+
+	limit := logContext.Limit
+	if limit <= 0 {
+		limit = defaultLogContextLimit
+	}
+	limit = min(limit, maxLogContextLimit)
+	op, order := "<", "DESC"
+	if logContext.Direction == models.LogContextForward {
+		op, order = ">", "ASC"
+	}
+	at := "'" + time.UnixMilli(logContext.Time).UTC().Format(time.RFC3339Nano) + "'"
+	column := quoteIdentifier(timeColumn)
+
+	wrapped := *q
+	wrapped.RawSQL = fmt.Sprintf("SELECT * FROM (%s) AS log_context WHERE %s %s %s ORDER BY %s %s LIMIT %d", inner, column, op, at, column, order, limit)
+	return d.runQuery(ctx, &wrapped)
+}
+
+// logContextTimeColumn picks the time column of a DESCRIBE result the same way formatLogs does.
+func logContextTimeColumn(columns *data.Frame) string {
+	if len(columns.Fields) < 2 {
+		return ""
+	}
+	var first string
+	byName := map[string]string{}
+	for i := 0; i < columns.Rows(); i++ {
+		name := stringValue(columns.Fields[0], i)
+		columnType := strings.ToUpper(stringValue(columns.Fields[1], i))
+		if !strings.HasPrefix(columnType, "TIMESTAMP") && columnType != "DATE" {
+			continue
+		}
+		if first == "" {
+			first = name
+		}
+		if _, ok := byName[strings.ToLower(name)]; !ok {
+			byName[strings.ToLower(name)] = name
+		}
+	}
+	for _, name := range logTimestampColumns {
+		if column, ok := byName[name]; ok {
+			return column
+		}
+	}
+	return first
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
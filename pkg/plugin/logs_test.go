@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+func TestLogsFormat(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "initSql": "CREATE TABLE app_logs AS SELECT TIMESTAMP '2024-01-01' + to_seconds(i) AS ts, ['ERR', 'warn', 'INFO', '7'][i % 4 + 1] AS level, 'line ' || i AS message, 'api' AS service, i AS seq FROM range(0, 100) t(i);"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	query := func(model map[string]any) *data.Frame {
+		t.Helper()
+		model["rawSql"] = "SELECT ts, level, message, service, seq FROM app_logs WHERE $__timeFilter(ts) ORDER BY ts"
+		model["format"] = sqlutil.FormatOptionLogs
+		encoded, _ := json.Marshal(model)
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID:     "A",
+				JSON:      encoded,
+				TimeRange: backend.TimeRange{From: start, To: start.Add(time.Hour)},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Responses["A"].Error != nil {
+			t.Fatal(resp.Responses["A"].Error)
+		}
+		return resp.Responses["A"].Frames[0]
+	}
+
+	frame := query(map[string]any{})
+	if frame.Meta.Type != data.FrameTypeLogLines {
+		t.Errorf("expected a log lines frame, got %q", frame.Meta.Type)
+	}
+	var names []string
+	for _, field := range frame.Fields {
+		names = append(names, field.Name)
+	}
+	if want := []string{"timestamp", "body", "severity", "id", "labels"}; len(names) != len(want) || names[1] != "body" || names[2] != "severity" {
+		t.Fatalf("expected fields %v, got %v", want, names)
+	}
+	if frame.Rows() != 100 {
+		t.Fatalf("expected 100 log lines, got %d", frame.Rows())
+	}
+	for i, want := range []string{"error", "warning", "info", "debug"} {
+		if got := frame.Fields[2].At(i); got != want {
+			t.Errorf("row %d: expected level %q, got %q", i, want, got)
+		}
+	}
+	if body := frame.Fields[1].At(5); body != "line 5" {
+		t.Errorf("expected the message column as body, got %q", body)
+	}
+	labels := map[string]string{}
+	if err := json.Unmarshal(frame.Fields[4].At(5).(json.RawMessage), &labels); err != nil {
+		t.Fatal(err)
+	}
+	if labels["service"] != "api" || labels["seq"] != "5" {
+		t.Errorf("expected the remaining columns as labels, got %v", labels)
+	}
+
+	at := start.Add(50 * time.Second).UnixMilli()
+	backward := query(map[string]any{"logContext": map[string]any{"time": at, "direction": "backward", "limit": 3}})
+	if backward.Rows() != 3 || backward.Fields[1].At(0) != "line 49" || backward.Fields[1].At(2) != "line 47" {
+		t.Errorf("expected the 3 lines before line 50, got %d rows starting with %v", backward.Rows(), backward.Fields[1].At(0))
+	}
+	forward := query(map[string]any{"logContext": map[string]any{"time": at, "direction": "forward", "limit": 3}})
+	if forward.Rows() != 3 || forward.Fields[1].At(0) != "line 51" || forward.Fields[1].At(2) != "line 53" {
+		t.Errorf("expected the 3 lines after line 50, got %d rows starting with %v", forward.Rows(), forward.Fields[1].At(0))
+	}
+}
+
+func TestFormatLogsWithoutTimeColumn(t *testing.T) {
+	frame := data.NewFrame("A", data.NewField("message", nil, []string{"a"}))
+	if _, err := formatLogs(frame); err == nil {
+		t.Error("expected logs without a time column to be rejected")
+	}
+}
@@ -0,0 +1,415 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v3"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+// ErrorPolicy is returned when a query uses a statement type or function the datasource policy
+// does not allow.
+var ErrorPolicy = errors.New("the query is not allowed by the datasource policy")
+
+// queryPolicy restricts the statement types, table functions and scalar functions queries may
+// use. An empty allow list allows everything that is not denied.
+type queryPolicy struct {
+	allowedStatements     []string
+	deniedStatements      []string
+	allowedTableFunctions []string
+	deniedTableFunctions  []string
+	allowedFunctions      []string
+	deniedFunctions       []string
+	exemptRoles           []string
+}
+
+// newQueryPolicy returns the policy configured in config, or nil when no policy is configured.
+func newQueryPolicy(config *models.PluginSettings) *queryPolicy {
+	p := &queryPolicy{
+		allowedStatements:     normalizeNames(config.AllowedStatements, strings.ToUpper),
+		deniedStatements:      normalizeNames(config.DeniedStatements, strings.ToUpper),
+		allowedTableFunctions: normalizeNames(config.AllowedTableFunctions, strings.ToLower),
+		deniedTableFunctions:  normalizeNames(config.DeniedTableFunctions, strings.ToLower),
+		allowedFunctions:      normalizeNames(config.AllowedFunctions, strings.ToLower),
+		deniedFunctions:       normalizeNames(config.DeniedFunctions, strings.ToLower),
+		exemptRoles:           config.PolicyExemptRoles,
+	}
+	if len(p.allowedStatements)+len(p.deniedStatements) == 0 && !p.checksFunctions() {
+		return nil
+	}
+	return p
+}
+
+func normalizeNames(names []string, normalize func(string) string) []string {
+	var normalized []string
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			normalized = append(normalized, normalize(name))
+		}
+	}
+	return normalized
+}
+
+func (p *queryPolicy) checksFunctions() bool {
+	return len(p.allowedTableFunctions)+len(p.deniedTableFunctions)+len(p.allowedFunctions)+len(p.deniedFunctions) > 0
+}
+
+// exempt reports whether the user running the query has a role the policy does not apply to.
+func (p *queryPolicy) exempt(ctx context.Context) bool {
+	user := backend.UserFromContext(ctx)
+	if user == nil || user.Role == "" {
+		return false
+	}
+	for _, role := range p.exemptRoles {
+		if strings.EqualFold(role, user.Role) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check parses query with DuckDB's own parser and rejects it when one of its statements, or a
+// function called anywhere in their trees (subqueries and common table expressions included), is
+// not allowed by the policy.
+func (p *queryPolicy) Check(ctx context.Context, query string) error {
+	if p.exempt(ctx) {
+		return nil
+	}
+
+	serialized, err := serializeStatements(ctx, query)
+	if err != nil {
+		return sqlds.PluginError(fmt.Errorf("could not parse the query: %w", err))
+	}
+	if serialized.Error && !serialized.notSelect() {
+		return sqlds.DownstreamError(fmt.Errorf("%w: %s", sqlds.ErrorQuery, serialized.ErrorMessage))
+	}
+	if !serialized.Error {
+		// Every statement is a SELECT, the trees of the whole query are checked at once.
+		if !allowed("SELECT", p.allowedStatements, p.deniedStatements) {
+			return sqlds.DownstreamError(fmt.Errorf("%w: SELECT statements are not allowed", ErrorPolicy))
+		}
+		return p.checkFunctions(ctx, serialized)
+	}
+
+	// Only SELECT statements can be serialized, the statements are checked one by one to tell the
+	// others apart.
+	statements, err := extractStatements(ctx, query)
+	if errors.Is(err, errStatementBoundaries) {
+		return sqlds.DownstreamError(fmt.Errorf("%w: %s", ErrorPolicy, err.Error()))
+	} else if ctx.Err() != nil {
+		return sqlds.DownstreamError(fmt.Errorf("could not check the query: %w", err))
+	} else if err != nil {
+		return sqlds.DownstreamError(fmt.Errorf("%w: %s", sqlds.ErrorQuery, err.Error()))
+	}
+	for i, statement := range statements {
+		serialized, err := serializeStatements(ctx, statement.Text)
+		if err != nil {
+			return sqlds.PluginError(fmt.Errorf("could not parse the query: %w", err))
+		}
+		if serialized.Error && !serialized.notSelect() {
+			return sqlds.DownstreamError(fmt.Errorf("%w: %s", sqlds.ErrorQuery, serialized.ErrorMessage))
+		}
+
+		typeName := "SELECT"
+		if serialized.notSelect() {
+			typeName = statementType(ctx, statement.Text)
+		}
+		if typeName == "" {
+			if len(p.allowedStatements)+len(p.deniedStatements) > 0 {
+				return sqlds.DownstreamError(fmt.Errorf("%w: the type of statement %d could not be determined", ErrorPolicy, i+1))
+			}
+		} else if !allowed(typeName, p.allowedStatements, p.deniedStatements) {
+			return sqlds.DownstreamError(fmt.Errorf("%w: %s statements are not allowed", ErrorPolicy, typeName))
+		}
+		if !p.checksFunctions() {
+			continue
+		}
+		// DuckDB only serializes the tree of SELECT statements, the functions called by any other
+		// statement cannot be checked.
+		if serialized.notSelect() {
+			name := typeName
+			if name == "" {
+				name = "non-SELECT"
+			}
+			return sqlds.DownstreamError(fmt.Errorf("%w: the functions called by %s statements cannot be checked against the function policy", ErrorPolicy, name))
+		}
+		if err := p.checkFunctions(ctx, serialized); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFunctions rejects the serialized statements when they call a table function or function
+// the policy does not allow, under any of its names.
+func (p *queryPolicy) checkFunctions(ctx context.Context, serialized *serializedSQL) error {
+	if !p.checksFunctions() {
+		return nil
+	}
+	aliases, err := loadFunctionAliases(ctx)
+	if err != nil {
+		return sqlds.PluginError(fmt.Errorf("could not list the function aliases: %w", err))
+	}
+	calls := newFunctionCalls()
+	for _, tree := range serialized.Statements {
+		var node any
+		if err := json.Unmarshal(tree, &node); err != nil {
+			return sqlds.PluginError(fmt.Errorf("could not read the parsed query: %w", err))
+		}
+		collectFunctions(node, calls)
+	}
+	for _, name := range sortedNames(calls.tableFunctions) {
+		if !allowedFunction(name, p.allowedTableFunctions, p.deniedTableFunctions, aliases) {
+			return sqlds.DownstreamError(fmt.Errorf("%w: table function %s is not allowed", ErrorPolicy, name))
+		}
+	}
+	for _, name := range sortedNames(calls.functions) {
+		if !allowedFunction(name, p.allowedFunctions, p.deniedFunctions, aliases) {
+			return sqlds.DownstreamError(fmt.Errorf("%w: function %s is not allowed", ErrorPolicy, name))
+		}
+	}
+	// The queries and tables named by the arguments of query and query_table are only known once
+	// they are evaluated. They are checked when the arguments are constant, any other argument is
+	// only allowed when the allow list names the function.
+	for _, name := range sortedNames(calls.dynamic) {
+		if !slices.Contains(p.allowedTableFunctions, name) {
+			return sqlds.DownstreamError(fmt.Errorf("%w: the argument of table function %s must be a constant string to be checked against the function policy", ErrorPolicy, name))
+		}
+	}
+	for _, query := range calls.queries {
+		if err := p.Check(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func allowed(name string, allow, deny []string) bool {
+	if slices.Contains(deny, name) {
+		return false
+	}
+	return len(allow) == 0 || slices.Contains(allow, name)
+}
+
+// allowedFunction is allowed for functions, which are compared by the function they alias: a
+// denied function is denied under each of its names.
+func allowedFunction(name string, allow, deny []string, aliases map[string]string) bool {
+	canonical := func(name string) string {
+		if function, ok := aliases[name]; ok {
+			return function
+		}
+		return name
+	}
+	name = canonical(name)
+	matches := func(names []string) bool {
+		return slices.ContainsFunc(names, func(n string) bool { return canonical(n) == name })
+	}
+	if matches(deny) {
+		return false
+	}
+	return len(allow) == 0 || matches(allow)
+}
+
+// tableFunctionAliases groups the table functions that read the same files in the same way under
+// the function named in the policy. DuckDB does not record them as aliases of one another.
+var tableFunctionAliases = map[string]string{
+	"read_csv_auto":          "read_csv",
+	"sniff_csv":              "read_csv",
+	"read_json_auto":         "read_json",
+	"read_ndjson":            "read_json",
+	"read_ndjson_auto":       "read_json",
+	"read_json_objects":      "read_json",
+	"read_json_objects_auto": "read_json",
+	"read_ndjson_objects":    "read_json",
+	"parquet_scan":           "read_parquet",
+}
+
+// functionAliases maps the aliases of DuckDB's functions, like ucase, to the function they alias,
+// like upper, along with tableFunctionAliases. They are listed once, from the parser database.
+var functionAliases struct {
+	mu      sync.Mutex
+	aliases map[string]string
+}
+
+func loadFunctionAliases(ctx context.Context) (map[string]string, error) {
+	functionAliases.mu.Lock()
+	defer functionAliases.mu.Unlock()
+	if functionAliases.aliases != nil {
+		return functionAliases.aliases, nil
+	}
+
+	if err := parser.open(); err != nil {
+		return nil, err
+	}
+	rows, err := parser.sqlDB.QueryContext(ctx, "SELECT DISTINCT lower(function_name), lower(alias_of) FROM duckdb_functions() WHERE alias_of IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	aliases := maps.Clone(tableFunctionAliases)
+	for rows.Next() {
+		var name, function string
+		if err := rows.Scan(&name, &function); err != nil {
+			return nil, err
+		}
+		aliases[name] = function
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	functionAliases.aliases = aliases
+	return aliases, nil
+}
+
+// functionCalls are the functions a statement tree calls.
+type functionCalls struct {
+	tableFunctions map[string]bool
+	functions      map[string]bool
+	// queries are the constant queries passed to the query table function.
+	queries []string
+	// dynamic names query and query_table when their query or table is not a constant.
+	dynamic map[string]bool
+}
+
+func newFunctionCalls() *functionCalls {
+	return &functionCalls{tableFunctions: map[string]bool{}, functions: map[string]bool{}, dynamic: map[string]bool{}}
+}
+
+// collectFunctions walks a statement tree serialized by json_serialize_sql and records the table
+// functions and the scalar, aggregate and window functions it calls. Operators are serialized as
+// functions too, they are skipped.
+func collectFunctions(node any, calls *functionCalls) {
+	switch n := node.(type) {
+	case []any:
+		for _, child := range n {
+			collectFunctions(child, calls)
+		}
+	case map[string]any:
+		isTableFunction := n["type"] == "TABLE_FUNCTION"
+		switch {
+		case isTableFunction:
+			if function, ok := n["function"].(map[string]any); ok {
+				name := functionName(function)
+				calls.tableFunctions[name] = true
+				collectQueryArgument(name, function, calls)
+			}
+		case n["type"] == "BASE_TABLE":
+			// Files can be queried as if they were tables (FROM 'data.csv'), DuckDB then scans them
+			// with the reader matching their extension.
+			if name, ok := n["table_name"].(string); ok && n["schema_name"] == "" {
+				if reader := fileReader(name); reader != "" {
+					calls.tableFunctions[reader] = true
+				}
+			}
+		case n["class"] == "FUNCTION" && n["is_operator"] != true, n["class"] == "WINDOW":
+			calls.functions[functionName(n)] = true
+		}
+		for key, child := range n {
+			if isTableFunction && key == "function" {
+				// The arguments of a table function may call functions of their own.
+				if function, ok := child.(map[string]any); ok {
+					collectFunctions(function["children"], calls)
+				}
+				continue
+			}
+			collectFunctions(child, calls)
+		}
+	}
+}
+
+// collectQueryArgument records what the query and query_table table functions run: the query
+// passed to query, which is checked as a query of its own, and the tables passed to query_table,
+// which may be files like the tables of a FROM clause.
+func collectQueryArgument(name string, function map[string]any, calls *functionCalls) {
+	if name != "query" && name != "query_table" {
+		return
+	}
+	children, _ := function["children"].([]any)
+	var argument any
+	if len(children) > 0 {
+		argument = children[0]
+	}
+	if name == "query" {
+		if query, ok := constantString(argument); ok {
+			calls.queries = append(calls.queries, query)
+		} else {
+			calls.dynamic[name] = true
+		}
+		return
+	}
+
+	tables := []any{argument}
+	if list, ok := argument.(map[string]any); ok && list["class"] == "FUNCTION" && functionName(list) == "list_value" {
+		tables, _ = list["children"].([]any)
+	}
+	for _, table := range tables {
+		table, ok := constantString(table)
+		if !ok {
+			calls.dynamic[name] = true
+			continue
+		}
+		if reader := fileReader(table); reader != "" {
+			calls.tableFunctions[reader] = true
+		}
+	}
+}
+
+// constantString returns the value of a serialized VARCHAR constant.
+func constantString(node any) (string, bool) {
+	n, ok := node.(map[string]any)
+	if !ok || n["class"] != "CONSTANT" {
+		return "", false
+	}
+	value, _ := n["value"].(map[string]any)
+	if value == nil || value["is_null"] == true {
+		return "", false
+	}
+	s, ok := value["value"].(string)
+	return s, ok
+}
+
+func functionName(function map[string]any) string {
+	name, _ := function["function_name"].(string)
+	return strings.ToLower(name)
+}
+
+// fileReader returns the table function DuckDB uses to scan a file referenced as a table, or an
+// empty string when name does not look like a file. Files of other types are reported as
+// "replacement_scan".
+func fileReader(name string) string {
+	if !strings.ContainsAny(name, "./\\") {
+		return ""
+	}
+	lower := strings.ToLower(name)
+	for _, compression := range []string{".gz", ".zst"} {
+		lower = strings.TrimSuffix(lower, compression)
+	}
+	switch path.Ext(lower) {
+	case ".csv", ".tsv":
+		return "read_csv"
+	case ".parquet":
+		return "read_parquet"
+	case ".json", ".jsonl", ".ndjson":
+		return "read_json"
+	}
+	return "replacement_scan"
+}
+
+func sortedNames(names map[string]bool) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
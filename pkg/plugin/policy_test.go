@@ -0,0 +1,120 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestQueryPolicy(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{
+			"path": "",
+			"deniedStatements": ["copy", "attach"],
+			"deniedTableFunctions": ["read_csv", "read_json", "read_text", "glob"],
+			"deniedFunctions": ["getenv", "upper"],
+			"policyExemptRoles": ["Admin"]
+		}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		sql      string
+		role     string
+		rejected string
+	}{
+		{"plain select", "SELECT 1 + 1 AS two, lower('A') AS a", "Viewer", ""},
+		{"allowed table function", "SELECT * FROM range(3)", "Viewer", ""},
+		{"denied statement", "COPY (SELECT 1) TO 'out.csv'", "Viewer", "COPY statements are not allowed"},
+		{"denied table function", "SELECT * FROM read_csv('/etc/passwd')", "Viewer", "table function read_csv"},
+		{"file queried as a table", "SELECT * FROM '/etc/hosts.csv'", "Viewer", "table function read_csv"},
+		{"table function in a CTE", "WITH files AS (SELECT * FROM glob('/*')) SELECT count(*) FROM files", "Viewer", "table function glob"},
+		{"table function in a nested subquery", "SELECT (SELECT max(content) FROM (SELECT * FROM read_text('/etc/hosts'))) AS c", "Viewer", "table function read_text"},
+		{"scalar function in an IN subquery", "SELECT 1 AS v WHERE 'x' IN (SELECT getenv('HOME'))", "Viewer", "function getenv"},
+		{"scalar function in a table function argument", "SELECT * FROM range(length(getenv('HOME')))", "Viewer", "function getenv"},
+		{"second statement", "SELECT 1 AS v; SELECT * FROM glob('/*')", "Viewer", "table function glob"},
+		{"function name in a string", "SELECT 'read_csv(x)' AS s", "Viewer", ""},
+		{"alias of a denied table function", "SELECT * FROM read_csv_auto('/etc/passwd')", "Viewer", "table function read_csv_auto"},
+		{"csv sniffer", "SELECT * FROM sniff_csv('/etc/passwd')", "Viewer", "table function sniff_csv"},
+		{"newline-delimited json", "SELECT * FROM read_ndjson('/etc/hosts.json')", "Viewer", "table function read_ndjson"},
+		{"json reader with detection", "SELECT * FROM read_json_auto('/etc/hosts.json')", "Viewer", "table function read_json_auto"},
+		{"alias of a denied function", "SELECT ucase('a') AS a", "Viewer", "function ucase"},
+		{"statement keyword in a comment", "/* SELECT */ COPY (SELECT 1) TO 'out.csv'", "Viewer", "COPY statements are not allowed"},
+		{"statement after a dollar-quoted semicolon", "SELECT $s$;$s$ AS s; ATTACH 'other.duckdb'", "Viewer", "ATTACH statements are not allowed"},
+		{"statement type behind common table expressions", "WITH t AS (SELECT 1) INSERT INTO x SELECT * FROM t", "Viewer", "the type of statement 1 could not be determined"},
+		{"denied table function in a query string", "SELECT * FROM query('SELECT * FROM read_text(''/etc/hosts'')')", "Viewer", "table function read_text"},
+		{"denied function in a nested query string", "SELECT * FROM query('SELECT * FROM query(''SELECT getenv(HOME) AS h'')')", "Viewer", "function getenv"},
+		{"allowed query string", "SELECT * FROM query('SELECT 42 AS v')", "Viewer", ""},
+		{"computed query string", "SELECT * FROM query('SELECT * FROM read_' || 'text(''/etc/hosts'')')", "Viewer", "table function query must be a constant string"},
+		{"file passed to query_table", "SELECT * FROM query_table('/etc/hosts.csv')", "Viewer", "table function read_csv"},
+		{"files passed to query_table", "SELECT * FROM query_table(['a.parquet', '/etc/hosts.json'])", "Viewer", "table function read_json"},
+		{"computed table passed to query_table", "SELECT * FROM query_table(lower('/etc/hosts.csv'))", "Viewer", "table function query_table must be a constant string"},
+		{"exempt role", "SELECT count(*) AS n FROM glob('/nonexistent/*')", "Admin", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			model, _ := json.Marshal(map[string]any{"rawSql": tc.sql, "format": 1})
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				PluginContext: backend.PluginContext{User: &backend.User{Login: "user", Role: tc.role}},
+				Queries:       []backend.DataQuery{{RefID: "A", JSON: model}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := resp.Responses["A"]
+			if tc.rejected == "" {
+				if res.Error != nil {
+					t.Fatal(res.Error)
+				}
+				return
+			}
+			if !errors.Is(res.Error, ErrorPolicy) || !strings.Contains(res.Error.Error(), tc.rejected) {
+				t.Errorf("expected the query to be rejected with %q, got: %v", tc.rejected, res.Error)
+			}
+		})
+	}
+}
+
+func TestQueryPolicyAllowList(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path": "", "allowedStatements": ["SELECT"], "allowedTableFunctions": ["range"]}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for sql, rejected := range map[string]string{
+		"SELECT * FROM range(3)":                  "",
+		"SELECT * FROM generate_series(1, 3)":     "table function generate_series",
+		"SET VARIABLE x = 1; SELECT 1 AS v":       "SET statements are not allowed",
+		"SELECT * FROM range(3) UNION SELECT 1":   "",
+		"SELECT * FROM (FROM read_parquet('x'))":  "table function read_parquet",
+		"SELECT * FROM 'data/metrics.parquet.gz'": "table function read_parquet",
+		"SELECT * FROM query('SELECT 1 AS v')":    "table function query",
+	} {
+		model, _ := json.Marshal(map[string]any{"rawSql": sql, "format": 1})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: model}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := resp.Responses["A"]
+		if rejected == "" {
+			if res.Error != nil {
+				t.Errorf("%s: %v", sql, res.Error)
+			}
+		} else if !errors.Is(res.Error, ErrorPolicy) || !strings.Contains(res.Error.Error(), rejected) {
+			t.Errorf("%s: expected the query to be rejected with %q, got: %v", sql, rejected, res.Error)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/sqlds/v3"
+)
+
+const (
+	defaultPreviewRows  = 100
+	maxPreviewRows      = 10000
+	defaultPreviewBytes = 1 << 20
+	maxPreviewBytes     = 16 << 20
+)
+
+// previewRequest is the body of the /preview resource.
+type previewRequest struct {
+	Database string `json:"database,omitempty"`
+	Schema   string `json:"schema,omitempty"`
+	Table    string `json:"table"`
+	Limit    int    `json:"limit,omitempty"`
+	// MaxBytes bounds the size of the encoded rows, rows past it are left out.
+	MaxBytes int `json:"maxBytes,omitempty"`
+	// Sample picks the rows at random with a reservoir sample instead of taking the first ones.
+	Sample bool `json:"sample,omitempty"`
+	// Seed makes the sample repeatable.
+	Seed *int `json:"seed,omitempty"`
+}
+
+// handlePreview returns the first rows, or a sample of the rows, of a table or view. The rows are
+// read by a query that goes through the same read-only and policy checks as panel queries.
+func (d *SQLDataSourceWrapper) handlePreview(rw http.ResponseWriter, req *http.Request) {
+	var options previewRequest
+	if err := json.NewDecoder(req.Body).Decode(&options); err != nil {
+		sendResourceError(rw, http.StatusBadRequest, fmt.Errorf("%w: %v", sqlds.ErrorWrongOptions, err))
+		return
+	}
+	q, err := previewQuery(&options)
+	if err != nil {
+		sendResourceError(rw, http.StatusBadRequest, err)
+		return
+	}
+	maxBytes := options.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultPreviewBytes
+	}
+	if maxBytes < 0 || maxBytes > maxPreviewBytes {
+		sendResourceError(rw, http.StatusBadRequest, fmt.Errorf("%w: maxBytes must be between 1 and %d", sqlds.ErrorWrongOptions, maxPreviewBytes))
+		return
+	}
+
+	ctx := req.Context()
+	if err := d.checkResourceQuery(ctx, q.RawSQL); err != nil {
+		sendResourceError(rw, queryErrorStatus(err), err)
+		return
+	}
+	truncated := false
+	frame, err := d.readQuery(ctx, q, readRowsWithinBytes(q.RefID, maxBytes, &truncated))
+	if err != nil {
+		sendResourceError(rw, queryErrorStatus(err), err)
+		return
+	}
+	sendResource(rw, map[string]any{
+		"query":     q.RawSQL,
+		"frame":     frame,
+		"truncated": truncated,
+	})
+}
+
+// previewQuery returns the query reading the rows of the table of options.
+func previewQuery(options *previewRequest) (*sqlutil.Query, error) {
+	if options.Table == "" {
+		return nil, fmt.Errorf("%w: the table option is required", sqlds.ErrorWrongOptions)
+	}
+	if options.Database != "" && options.Schema == "" {
+		return nil, fmt.Errorf("%w: the schema option is required with the database option", sqlds.ErrorWrongOptions)
+	}
+	limit := options.Limit
+	if limit == 0 {
+		limit = defaultPreviewRows
+	}
+	if limit < 0 || limit > maxPreviewRows {
+		return nil, fmt.Errorf("%w: the limit must be between 1 and %d", sqlds.ErrorWrongOptions, maxPreviewRows)
+	}
+
+	var name []string
+	for _, part := range []string{options.Database, options.Schema, options.Table} {
+		if part != "" {
+			name = append(name, quoteIdentifier(part))
+		}
+	}
+	source := strings.Join(name, ".")
+	if options.Sample {
+		source += fmt.Sprintf(" TABLESAMPLE reservoir(%d ROWS)", limit)
+		if options.Seed != nil {
+			source += fmt.Sprintf(" REPEATABLE (%d)", *options.Seed)
+		}
+	}
+	return &sqlutil.Query{
+		RefID:  "preview",
+		RawSQL: fmt.Sprintf("SELECT * FROM %s LIMIT %d", source, limit),
+	}, nil
+}
+
+// readRowsWithinBytes returns a frameReader for the frame name that reads rows until the next
+// one would take the JSON encoding of the frame past maxBytes, and then sets truncated. The rows
+// past it are never read. Each row is measured once as it is read, by the encoded size of its
+// values.
+func readRowsWithinBytes(name string, maxBytes int, truncated *bool) frameReader {
+	return func(rows *sql.Rows, converters []sqlutil.Converter) (*data.Frame, error) {
+		types, err := rows.ColumnTypes()
+		if err != nil {
+			return nil, err
+		}
+		names, err := rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+		scanRow, err := sqlutil.MakeScanRow(types, names, converters...)
+		if err != nil {
+			return nil, err
+		}
+		frame := sqlutil.NewFrame(names, scanRow.Converters...)
+		frame.Name = name
+		encoded, err := json.Marshal(frame)
+		if err != nil {
+			return nil, err
+		}
+		size := len(encoded)
+		if size > maxBytes {
+			return nil, fmt.Errorf("the columns alone encode to more than %d bytes", maxBytes)
+		}
+
+		for rows.Next() {
+			row := scanRow.NewScannableRow()
+			if err := rows.Scan(row...); err != nil {
+				return nil, err
+			}
+			if err := sqlutil.Append(frame, row, scanRow.Converters...); err != nil {
+				return nil, err
+			}
+			last := frame.Rows() - 1
+			rowSize := 0
+			for _, field := range frame.Fields {
+				// The values of a field are separated by commas.
+				rowSize += encodedValueSize(field.At(last)) + 1
+			}
+			if size+rowSize > maxBytes {
+				for _, field := range frame.Fields {
+					field.Delete(last)
+				}
+				*truncated = true
+				break
+			}
+			size += rowSize
+		}
+		return frame, rows.Err()
+	}
+}
+
+// encodedValueSize returns the size of the JSON encoding of a value of a field. Values JSON cannot
+// encode, like NaN, are encoded as null.
+func encodedValueSize(v any) int {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return len("null")
+	}
+	return len(encoded)
+}
@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestPreview(t *testing.T) {
+	newDatasource := func(settings string) *SQLDataSourceWrapper {
+		t.Helper()
+		initSQL := `CREATE SCHEMA staging; CREATE TABLE staging.\"odd \"\"name\"\"\" AS SELECT i AS id, repeat('x', 100) AS padding FROM range(0, 1000) t(i);`
+		ds := NewDatasource(&DuckDBDriver{Initialized: false})
+		_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{"path":"", "initSql": "` + initSQL + `"` + settings + `}`),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ds
+	}
+	ds := newDatasource("")
+	table := `odd "name"`
+
+	tests := []struct {
+		name      string
+		ds        *SQLDataSourceWrapper
+		options   map[string]any
+		status    int
+		rows      int
+		truncated bool
+		message   string
+	}{
+		{"first rows", nil, map[string]any{"schema": "staging", "table": table, "limit": 5}, http.StatusOK, 5, false, ""},
+		{"default limit", nil, map[string]any{"database": "memory", "schema": "staging", "table": table}, http.StatusOK, defaultPreviewRows, false, ""},
+		{"sample", nil, map[string]any{"schema": "staging", "table": table, "limit": 20, "sample": true, "seed": 7}, http.StatusOK, 20, false, ""},
+		{"byte limit", nil, map[string]any{"schema": "staging", "table": table, "limit": 1000, "maxBytes": 10000}, http.StatusOK, -1, true, ""},
+		{"no table", nil, map[string]any{}, http.StatusBadRequest, 0, false, "the table option is required"},
+		{"limit", nil, map[string]any{"table": table, "limit": 20000}, http.StatusBadRequest, 0, false, "the limit must be between 1 and 10000"},
+		{"missing table", nil, map[string]any{"table": "missing"}, http.StatusBadRequest, 0, false, "Table with name missing does not exist"},
+		{"policy", newDatasource(`, "allowedStatements": ["DESCRIBE"]`), map[string]any{"schema": "staging", "table": table}, http.StatusForbidden, 0, false, "SELECT statements are not allowed"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			target := ds
+			if tc.ds != nil {
+				target = tc.ds
+			}
+			body, _ := json.Marshal(tc.options)
+			resp := callResource(t, target, "preview", body)
+			if resp.Status != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, resp.Status, resp.Body)
+			}
+			if tc.status != http.StatusOK {
+				if !strings.Contains(string(resp.Body), tc.message) {
+					t.Errorf("expected %q in %s", tc.message, resp.Body)
+				}
+				return
+			}
+			var preview struct {
+				Frame     *data.Frame `json:"frame"`
+				Truncated bool        `json:"truncated"`
+			}
+			if err := json.Unmarshal(resp.Body, &preview); err != nil {
+				t.Fatal(err)
+			}
+			if preview.Truncated != tc.truncated {
+				t.Errorf("expected truncated to be %v", tc.truncated)
+			}
+			rows := preview.Frame.Rows()
+			if tc.rows >= 0 && rows != tc.rows {
+				t.Errorf("expected %d rows, got %d", tc.rows, rows)
+			}
+			if tc.truncated {
+				encoded, _ := json.Marshal(preview.Frame)
+				if rows == 0 || len(encoded) > 10000 {
+					t.Errorf("expected the rows fitting in 10000 bytes, got %d rows in %d bytes", rows, len(encoded))
+				}
+			}
+		})
+	}
+}
+
+func TestPreviewAdmission(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path": "", "initSql": "CREATE TABLE metrics AS SELECT i AS id FROM range(0, 100) t(i);", "maxConcurrentQueries": 1}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string]any{"table": "metrics", "sample": true, "limit": 10})
+	expectSlotWait(t, ds, func() {
+		if resp := callResource(t, ds, "preview", body); resp.Status != http.StatusOK {
+			t.Errorf("expected status 200, got %d: %s", resp.Status, resp.Body)
+		}
+	})
+}
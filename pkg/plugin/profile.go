@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"strconv"
+	"strings"
+
+	duckdb "github.com/duckdb/duckdb-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// profilingMetrics are the metrics read by newQueryProfile. DuckDB only collects the metrics
+// enabled in its custom_profiling_settings.
+var profilingMetrics = []string{
+	"LATENCY", "ROWS_RETURNED", "CUMULATIVE_ROWS_SCANNED", "TOTAL_BYTES_READ", "SYSTEM_PEAK_BUFFER_MEMORY",
+	"OPERATOR_NAME", "OPERATOR_CARDINALITY", "OPERATOR_ROWS_SCANNED", "OPERATOR_TIMING", "EXTRA_INFO",
+}
+
+// enableProfiling enables the profiling of the queries of a connection, and resetProfiling
+// restores the defaults once the profile has been read, so the connection can go back to the pool.
+var (
+	enableProfiling = "PRAGMA enable_profiling = 'no_output'; PRAGMA custom_profiling_settings = '{" +
+		`"` + strings.Join(profilingMetrics, `": "true", "`) + `": "true"` + "}'"
+	resetProfiling = "PRAGMA disable_profiling; RESET custom_profiling_settings"
+)
+
+// queryProfile summarizes the profiling information DuckDB collected for a query. It is attached
+// to the result frame as custom metadata, so that full scans can be spotted in the query inspector.
+type queryProfile struct {
+	Latency          float64           `json:"latency"`
+	RowsReturned     int64             `json:"rowsReturned"`
+	RowsScanned      int64             `json:"rowsScanned"`
+	BytesRead        int64             `json:"bytesRead"`
+	PeakBufferMemory int64             `json:"peakBufferMemory"`
+	Operators        []operatorProfile `json:"operators,omitempty"`
+}
+
+// operatorProfile holds the metrics of a single operator of the query plan.
+type operatorProfile struct {
+	Name        string            `json:"name"`
+	Rows        int64             `json:"rows"`
+	RowsScanned int64             `json:"rowsScanned"`
+	Time        float64           `json:"time"`
+	Info        string            `json:"info,omitempty"`
+	Children    []operatorProfile `json:"children,omitempty"`
+}
+
+func newQueryProfile(info duckdb.ProfilingInfo) *queryProfile {
+	p := &queryProfile{
+		Latency:          floatMetric(info.Metrics, "LATENCY"),
+		RowsReturned:     intMetric(info.Metrics, "ROWS_RETURNED"),
+		RowsScanned:      intMetric(info.Metrics, "CUMULATIVE_ROWS_SCANNED"),
+		BytesRead:        intMetric(info.Metrics, "TOTAL_BYTES_READ"),
+		PeakBufferMemory: intMetric(info.Metrics, "SYSTEM_PEAK_BUFFER_MEMORY"),
+	}
+	for _, child := range info.Children {
+		p.Operators = append(p.Operators, newOperatorProfile(child))
+	}
+	return p
+}
+
+func newOperatorProfile(info duckdb.ProfilingInfo) operatorProfile {
+	op := operatorProfile{
+		Name:        info.Metrics["OPERATOR_NAME"],
+		Rows:        intMetric(info.Metrics, "OPERATOR_CARDINALITY"),
+		RowsScanned: intMetric(info.Metrics, "OPERATOR_ROWS_SCANNED"),
+		Time:        floatMetric(info.Metrics, "OPERATOR_TIMING"),
+	}
+	if extra := info.Metrics["EXTRA_INFO"]; extra != "{}" {
+		op.Info = extra
+	}
+	for _, child := range info.Children {
+		op.Children = append(op.Children, newOperatorProfile(child))
+	}
+	return op
+}
+
+// attach adds the profile to the metadata of frame, both as custom metadata holding the operator
+// tree and as query stats shown in the query inspector.
+func (p *queryProfile) attach(frame *data.Frame) {
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.Custom = map[string]any{"profile": p}
+	frame.Meta.Stats = append(frame.Meta.Stats,
+		data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Query time", Unit: "s"}, Value: p.Latency},
+		data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Rows returned"}, Value: float64(p.RowsReturned)},
+		data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Rows scanned"}, Value: float64(p.RowsScanned)},
+		data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Bytes read", Unit: "bytes"}, Value: float64(p.BytesRead)},
+		data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Peak buffer memory", Unit: "bytes"}, Value: float64(p.PeakBufferMemory)},
+	)
+}
+
+func intMetric(metrics map[string]string, name string) int64 {
+	v, _ := strconv.ParseInt(metrics[name], 10, 64)
+	return v
+}
+
+func floatMetric(metrics map[string]string, name string) float64 {
+	v, _ := strconv.ParseFloat(metrics[name], 64)
+	return v
+}
@@ -0,0 +1,584 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	duckdb "github.com/duckdb/duckdb-go/v2"
+	"github.com/grafana/dataplane/sdata/timeseries"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/sqlds/v3"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+// handleQuery runs a single query on a connection pinned for the lifetime of the query.
+//
+// sqlds runs queries through the shared *sql.DB and, when a query hits its deadline, closes and
+// reopens the whole database before retrying it. For an embedded DuckDB that aborts every other
+// in-flight query and reruns the expensive statement, so queries are executed here instead. When
+// ctx is done DuckDB interrupts the statement running on the pinned connection, and the connection
+// is handed back to the pool as soon as the query returns.
+//
+// The driver hooks of sqlds are honored: QueryMutator and QueryArgSetter here, ResponseMutator in
+// QueryData, and errors matching the RetryOn settings are retried by retryQuery. Timed out queries
+// are not retried.
+func (d *SQLDataSourceWrapper) handleQuery(ctx context.Context, query backend.DataQuery, headers http.Header) (data.Frames, error) {
+	if mutator, ok := d.driver.(sqlds.QueryMutator); ok {
+		ctx, query = mutator.MutateQuery(ctx, query)
+	}
+	if argSetter, ok := d.driver.(sqlds.QueryArgSetter); ok {
+		ctx = context.WithValue(ctx, queryArgsKey{}, argSetter.SetQueryArgs(ctx, headers))
+	}
+
+	q, err := sqlds.GetQuery(query, headers, d.DriverSettings().ForwardHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	model, err := models.LoadQueryModel(query)
+	if err != nil {
+		return nil, sqlds.PluginError(err)
+	}
+
+	if model.LogContext != nil {
+		q.TimeRange = logContextTimeRange(q.TimeRange, model.LogContext)
+	} else if d.cache != nil {
+		q.TimeRange = d.cache.roundTimeRange(q.TimeRange)
+	}
+
+	// Keep the query with its macros unexpanded, incremental queries expand them per time range.
+	template := *q
+	if model.Stream != nil && model.Stream.Files != "" {
+		// File streams read every file with the same query, it is checked with the glob in place
+		// of the file.
+		q.RawSQL = fileStreamQuery(q.RawSQL, model.Stream.Files)
+	}
+
+	q.RawSQL, err = sqlutil.Interpolate(q, d.driver.Macros())
+	if err != nil {
+		return sqlutil.ErrorFrameFromQuery(q), fmt.Errorf("%s: %w", "Could not apply macros", err)
+	}
+
+	// Checked before the cache is consulted, users exempt from the policy may have cached results
+	// of queries others must not run.
+	if d.readOnly {
+		if err := checkReadOnly(ctx, q.RawSQL); err != nil {
+			return sqlutil.ErrorFrameFromQuery(q), err
+		}
+	}
+
+	if d.policy != nil {
+		if err := d.policy.Check(ctx, q.RawSQL); err != nil {
+			return sqlutil.ErrorFrameFromQuery(q), err
+		}
+	}
+
+	key := resultCacheKey(d.settings.UID, q, model, queryArgs(ctx)...)
+	// Plans are not cached, EXPLAIN ANALYZE is meant to profile a fresh run of the query. Neither
+	// are log contexts, whose time range is not rounded, and streams, which follow new rows from
+	// where the query left off.
+	cache := d.cache
+	if model.Explain != "" || model.LogContext != nil || model.Stream != nil {
+		cache = nil
+	}
+	if cache != nil {
+		if frames, ok := cache.Get(key); ok {
+			return frames, nil
+		}
+	}
+
+	// Panels and viewers loading the same dashboard at once issue identical queries, they share a
+	// single execution and its result.
+	frames, err, shared := d.inflight.Do(ctx, d.inflightKey(ctx, key), func(ctx context.Context) (data.Frames, error) {
+		frames, err := d.executeQuery(ctx, q, &template, model)
+		if err == nil && cache != nil {
+			cache.Set(key, frames)
+		}
+		return frames, err
+	})
+	if shared {
+		coalescedQueries.WithLabelValues(d.metrics.DSName, d.metrics.DSType).Inc()
+	}
+	return frames, err
+}
+
+// inflightKey returns the key under which the query with the result cache key key is shared with
+// identical in-flight queries. The shared execution runs with the context of the caller that
+// started it, so it is only shared with callers of the same traffic class, which get the same
+// admission queue, and with the same exemption from the policy.
+func (d *SQLDataSourceWrapper) inflightKey(ctx context.Context, key string) string {
+	exempt := d.policy != nil && d.policy.exempt(ctx)
+	return fmt.Sprintf("%s\x00%s\x00%t", key, trafficClassFromContext(ctx), exempt)
+}
+
+// executeQuery runs the macro-expanded query q and converts its result according to the query
+// format. template is the same query with its macros unexpanded.
+func (d *SQLDataSourceWrapper) executeQuery(ctx context.Context, q *sqlutil.Query, template *sqlutil.Query, model *models.QueryModel) (data.Frames, error) {
+	if model.Explain != "" {
+		frames, err := d.explainQuery(ctx, q, model.Explain)
+		if err != nil {
+			return sqlutil.ErrorFrameFromQuery(q), err
+		}
+		return frames, nil
+	}
+	if model.Stream != nil {
+		frames, err := d.startStream(ctx, q, template, model.Stream)
+		if err != nil {
+			return sqlutil.ErrorFrameFromQuery(q), err
+		}
+		return frames, nil
+	}
+
+	fillMode := d.DriverSettings().FillMode
+	if q.FillMissing != nil {
+		fillMode = q.FillMissing
+	}
+
+	var (
+		frame *data.Frame
+		err   error
+	)
+	if model.LogContext != nil {
+		frame, err = d.runLogContextQuery(ctx, q, model.LogContext)
+	} else if model.Incremental {
+		frame, err = d.runIncrementalQuery(ctx, template)
+	} else {
+		frame, err = d.retryQuery(ctx, q)
+	}
+	if err != nil {
+		return sqlutil.ErrorFrameFromQuery(q), err
+	}
+
+	start := time.Now()
+	var profile *data.FrameMeta
+	if frame.Meta != nil && frame.Meta.Custom != nil {
+		profile = frame.Meta
+	}
+	frames, err := formatFrames(frame, fillMode, q, model)
+	if errors.Is(err, sqlds.ErrorNoResults) {
+		return nil, nil
+	}
+	if err != nil {
+		d.metrics.CollectDuration(sqlds.SourcePlugin, sqlds.StatusError, time.Since(start).Seconds())
+		return sqlutil.ErrorFrameFromQuery(q), sqlds.PluginError(fmt.Errorf("%w: %s", err, "Could not process SQL results"))
+	}
+	// Converting to the query format may build new frames, carry the profile over to them.
+	if profile != nil {
+		for _, f := range frames {
+			if f.Meta == nil {
+				f.Meta = &data.FrameMeta{}
+			}
+			f.Meta.Custom = profile.Custom
+			f.Meta.Stats = profile.Stats
+		}
+	}
+	d.metrics.CollectDuration(sqlds.SourcePlugin, sqlds.StatusOK, time.Since(start).Seconds())
+
+	return frames, nil
+}
+
+// retryQuery runs q with runQuery and retries it when it fails with an error matching the RetryOn
+// driver settings, pausing between attempts like sqlds does. Unlike sqlds, the database is not
+// reopened between attempts, every attempt gets a connection of its own anyway, and timed out
+// queries are not retried: a query that used up its timeout is likely to use it up again, and
+// while it reruns it holds a query slot.
+func (d *SQLDataSourceWrapper) retryQuery(ctx context.Context, q *sqlutil.Query) (*data.Frame, error) {
+	settings := d.DriverSettings()
+	frame, err := d.runQuery(ctx, q)
+	for i := 0; i < settings.Retries && retryable(settings.RetryOn, err); i++ {
+		backend.Logger.Warn("Query failed, retrying", "error", err, "attempt", i+1)
+		select {
+		case <-ctx.Done():
+			return nil, queryError(ctx, settings.Timeout, err)
+		case <-time.After(time.Duration(settings.Pause) * time.Second):
+		}
+		frame, err = d.runQuery(ctx, q)
+	}
+	return frame, err
+}
+
+// retryable tells whether err is a query error whose message contains one of retryOn.
+func retryable(retryOn []string, err error) bool {
+	if err == nil || !errors.Is(err, sqlds.ErrorQuery) {
+		return false
+	}
+	for _, message := range retryOn {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+type queryArgsKey struct{}
+
+// queryArgs returns the arguments the QueryArgSetter of the driver set for the queries of ctx.
+func queryArgs(ctx context.Context) []any {
+	args, _ := ctx.Value(queryArgsKey{}).([]any)
+	return args
+}
+
+// converters returns the converters of the columns of a query in format. Nested values are only
+// encoded as JSON for the formats that read them: traces for their tags, flame graphs for their
+// stacks and heatmaps for their histograms.
+func converters(format sqlutil.FormatQueryOption, driverConverters []sqlutil.Converter) []sqlutil.Converter {
+	switch format {
+	case sqlutil.FormatOptionTrace, models.FormatOptionFlameGraph, models.FormatOptionHeatmap:
+		return append([]sqlutil.Converter{nestedConverter}, driverConverters...)
+	}
+	return driverConverters
+}
+
+// runQuery runs the macro-expanded q.RawSQL on a pinned connection and returns its result as a
+// single frame, before any format conversion.
+func (d *SQLDataSourceWrapper) runQuery(ctx context.Context, q *sqlutil.Query) (*data.Frame, error) {
+	return d.readQuery(ctx, q, readAllRows)
+}
+
+// frameReader reads the rows of a query into a frame, with the converters of their columns.
+type frameReader func(rows *sql.Rows, converters []sqlutil.Converter) (*data.Frame, error)
+
+func readAllRows(rows *sql.Rows, converters []sqlutil.Converter) (*data.Frame, error) {
+	return sqlutil.FrameFromRows(rows, -1, converters...)
+}
+
+// readQuery is runQuery with the rows read by read, which may stop before the last row.
+func (d *SQLDataSourceWrapper) readQuery(ctx context.Context, q *sqlutil.Query, read frameReader) (*data.Frame, error) {
+	// Statements ahead of the final one run on the same connection as the final statement, whose
+	// result becomes the frame. They may only change the state of that connection, which is
+	// discarded afterwards instead of being returned to the pool, so that the setup does not leak
+	// into the queries of other panels.
+	statements, err := countStatements(q.RawSQL)
+	discardConn := err != nil || statements > 1
+	if statements > 1 {
+		if err := checkSetupStatements(ctx, q.RawSQL); err != nil {
+			if ctx.Err() != nil {
+				return nil, queryError(ctx, d.DriverSettings().Timeout, err)
+			}
+			return nil, err
+		}
+	}
+
+	db, err := d.GetDBFromQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.admission != nil {
+		release, err := d.admission.Acquire(ctx, trafficClassFromContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	timeout := d.DriverSettings().Timeout
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		d.metrics.CollectDuration(sqlds.SourceDownstream, sqlds.StatusError, time.Since(start).Seconds())
+		return nil, queryError(ctx, timeout, err)
+	}
+	defer func() {
+		if discardConn {
+			// database/sql closes a connection instead of pooling it when Raw reports it as bad.
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		if err := conn.Close(); err != nil && !errors.Is(err, sql.ErrConnDone) {
+			backend.Logger.Error(err.Error())
+		}
+	}()
+
+	if d.profiling {
+		if _, err := conn.ExecContext(ctx, enableProfiling); err != nil {
+			d.metrics.CollectDuration(sqlds.SourceDownstream, sqlds.StatusError, time.Since(start).Seconds())
+			return nil, queryError(ctx, timeout, err)
+		}
+		// Profiling stays enabled on the connection until it is reset, after the rows are closed.
+		// A connection that cannot be reset is kept out of the pool.
+		defer func() {
+			if _, err := conn.ExecContext(context.WithoutCancel(ctx), resetProfiling); err != nil {
+				backend.Logger.Debug("Could not reset query profiling", "error", err)
+				discardConn = true
+			}
+		}()
+	}
+
+	if d.memory != nil {
+		if err := d.memory.Check(ctx, conn); err != nil {
+			d.metrics.CollectDuration(sqlds.SourceDownstream, sqlds.StatusError, time.Since(start).Seconds())
+			if errors.Is(err, ErrorMemoryPressure) {
+				return nil, err
+			}
+			return nil, queryError(ctx, timeout, err)
+		}
+	}
+
+	rows, err := conn.QueryContext(ctx, q.RawSQL, queryArgs(ctx)...)
+	if err != nil {
+		d.metrics.CollectDuration(sqlds.SourceDownstream, sqlds.StatusError, time.Since(start).Seconds())
+		return nil, queryError(ctx, timeout, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			backend.Logger.Error(err.Error())
+		}
+	}()
+
+	frame, err := read(rows, converters(q.Format, d.driver.Converters()))
+	if err != nil {
+		d.metrics.CollectDuration(sqlds.SourceDownstream, sqlds.StatusError, time.Since(start).Seconds())
+		if ctx.Err() != nil {
+			return nil, queryError(ctx, timeout, err)
+		}
+		return nil, sqlds.PluginError(fmt.Errorf("%w: %s", err, "Could not process SQL results"))
+	}
+	d.metrics.CollectDuration(sqlds.SourceDownstream, sqlds.StatusOK, time.Since(start).Seconds())
+
+	if d.profiling {
+		// The profile is complete once every row has been read.
+		if info, err := duckdb.GetProfilingInfo(conn); err == nil {
+			newQueryProfile(info).attach(frame)
+		} else {
+			backend.Logger.Debug("Could not read the query profile", "error", err)
+		}
+	}
+
+	return frame, nil
+}
+
+// requireSingleStatement rejects query when it has several statements, for the query modes that
+// wrap the query or prefix it: setup statements ahead of the final statement would end up inside
+// a subquery, or run without the mode applying to them. mode names the mode in the error.
+func requireSingleStatement(query string, mode string) error {
+	if statements, err := countStatements(query); err == nil && statements > 1 {
+		return sqlds.DownstreamError(fmt.Errorf("%w: %s supports a single statement, the query has %d", sqlds.ErrorQuery, mode, statements))
+	}
+	return nil
+}
+
+// subquery returns query, a single statement, to be used as a subquery. Its trailing semicolons
+// are removed, and it ends with a newline so that a trailing line comment does not swallow the
+// closing parenthesis around it.
+func subquery(query string) string {
+	return strings.TrimRight(strings.TrimSpace(query), ";") + "\n"
+}
+
+// setupStatements are the leading keywords of the statements other than SELECT that may precede
+// the final statement of a query. They only change the connection they run on: settings of the session, variables,
+// the default database and schema, and temporary objects. A plain SET changes global settings,
+// like memory_limit or threads, for every connection of the database.
+var setupStatements = [][]string{
+	{"SET", "SESSION"},
+	{"SET", "VARIABLE"},
+	{"RESET", "SESSION"},
+	{"RESET", "VARIABLE"},
+	{"USE"},
+	{"CREATE", "TEMP"},
+	{"CREATE", "TEMPORARY"},
+	{"CREATE", "OR", "REPLACE", "TEMP"},
+	{"CREATE", "OR", "REPLACE", "TEMPORARY"},
+}
+
+// checkSetupStatements rejects a query with several statements when one ahead of the final
+// statement is not a setup statement.
+func checkSetupStatements(ctx context.Context, rawSQL string) error {
+	statements, err := extractStatements(ctx, rawSQL)
+	if ctx.Err() != nil {
+		return err
+	} else if err != nil {
+		return sqlds.DownstreamError(fmt.Errorf("%w: %s", sqlds.ErrorQuery, err.Error()))
+	}
+	for i, statement := range statements[:len(statements)-1] {
+		// SELECT statements change nothing, they are allowed anywhere.
+		serialized, err := serializeStatements(ctx, statement.Text)
+		if err != nil {
+			return err
+		}
+		if !serialized.Error {
+			continue
+		}
+		keywords := leadingKeywords(statement.Text, 4)
+		if !slices.ContainsFunc(setupStatements, func(prefix []string) bool {
+			return len(keywords) >= len(prefix) && slices.Equal(keywords[:len(prefix)], prefix)
+		}) {
+			return sqlds.DownstreamError(fmt.Errorf("%w: statement %d of the query cannot precede the final statement, only SELECT, SET SESSION, SET VARIABLE, RESET SESSION, RESET VARIABLE, USE and CREATE TEMP statements can", sqlds.ErrorQuery, i+1))
+		}
+	}
+	return nil
+}
+
+// leadingKeywords returns the first n words of a statement in upper case, comments skipped.
+func leadingKeywords(text string, n int) []string {
+	var keywords []string
+	for i := 0; i < len(text) && len(keywords) < n; {
+		switch {
+		case unicode.IsSpace(rune(text[i])):
+			i++
+		case strings.HasPrefix(text[i:], "--") || strings.HasPrefix(text[i:], "/*"):
+			i = commentEnd(text, i)
+		case isIdentifierByte(text[i]):
+			end := i
+			for end < len(text) && isIdentifierByte(text[end]) {
+				end++
+			}
+			keywords = append(keywords, strings.ToUpper(text[i:end]))
+			i = end
+		default:
+			return keywords
+		}
+	}
+	return keywords
+}
+
+// queryError classifies an error returned while running a query, so that cancelled and timed out
+// queries can be told apart from queries DuckDB rejected.
+func queryError(ctx context.Context, timeout time.Duration, err error) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return sqlds.DownstreamError(fmt.Errorf("%w: query exceeded %s and was interrupted: %s", sqlds.ErrorTimeout, timeout, err.Error()))
+	case errors.Is(ctx.Err(), context.Canceled):
+		return sqlds.DownstreamError(fmt.Errorf("%w: query was interrupted: %s", context.Canceled, err.Error()))
+	default:
+		return sqlds.DownstreamError(fmt.Errorf("%w: %s", sqlds.ErrorQuery, err.Error()))
+	}
+}
+
+// formatFrames converts the result of a query into frames according to the query format. It
+// mirrors the conversion sqlds applies to its own query results.
+func formatFrames(frame *data.Frame, fillMode *data.FillMissing, query *sqlutil.Query, model *models.QueryModel) (data.Frames, error) {
+	frame.Name = query.RefID
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+
+	count, err := frame.RowLen()
+	if err != nil {
+		return nil, err
+	}
+
+	// the handling of zero-rows differs between various "format"s.
+	zeroRows := count == 0
+
+	frame.Meta.ExecutedQueryString = query.RawSQL
+	frame.Meta.PreferredVisualization = data.VisTypeGraph
+
+	switch query.Format {
+	case sqlutil.FormatOptionMulti:
+		if zeroRows {
+			return nil, sqlds.ErrorNoResults
+		}
+		if err := selectSeriesColumns(frame, model); err != nil {
+			return nil, err
+		}
+
+		if frame.TimeSeriesSchema().Type == data.TimeSeriesTypeLong {
+			err = fixFrameForLongToMulti(frame)
+			if err != nil {
+				return nil, err
+			}
+
+			multi, err := timeseries.LongToMulti(&timeseries.LongFrame{frame})
+			if err != nil {
+				return nil, err
+			}
+			frames := multi.Frames()
+			setDisplayNames(frames, model.LegendFormat)
+			return frames, nil
+		}
+	case sqlutil.FormatOptionTable:
+		frame.Meta.PreferredVisualization = data.VisTypeTable
+	case sqlutil.FormatOptionLogs:
+		logs, err := formatLogs(frame)
+		if err != nil {
+			return nil, err
+		}
+		return data.Frames{logs}, nil
+	case sqlutil.FormatOptionTrace:
+		trace, err := formatTrace(frame)
+		if err != nil {
+			return nil, err
+		}
+		return data.Frames{trace}, nil
+	case models.FormatOptionNodeGraph:
+		return formatNodeGraph(frame, model.Columns)
+	case models.FormatOptionFlameGraph:
+		flame, err := formatFlameGraph(frame, model.Columns)
+		if err != nil {
+			return nil, err
+		}
+		return data.Frames{flame}, nil
+	case models.FormatOptionHeatmap:
+		heatmap, err := formatHeatmap(frame, model.Columns)
+		if err != nil {
+			return nil, err
+		}
+		return data.Frames{heatmap}, nil
+	// Format as timeSeries
+	default:
+		if zeroRows {
+			return nil, sqlds.ErrorNoResults
+		}
+		if err := selectSeriesColumns(frame, model); err != nil {
+			return nil, err
+		}
+
+		if frame.TimeSeriesSchema().Type == data.TimeSeriesTypeLong {
+			frame, err = data.LongToWide(frame, fillMode)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	frames := data.Frames{frame}
+	if query.Format != sqlutil.FormatOptionTable {
+		setDisplayNames(frames, model.LegendFormat)
+	}
+	return frames, nil
+}
+
+// fixFrameForLongToMulti edits the passed in frame so that it's first time field isn't nullable and has the correct meta
+func fixFrameForLongToMulti(frame *data.Frame) error {
+	if frame == nil {
+		return fmt.Errorf("can not convert to wide series, input is nil")
+	}
+
+	timeFields := frame.TypeIndices(data.FieldTypeTime, data.FieldTypeNullableTime)
+	if len(timeFields) == 0 {
+		return fmt.Errorf("can not convert to wide series, input is missing a time field")
+	}
+
+	// the timeseries package expects the first time field in the frame to be non-nullable and ignores the rest
+	timeField := frame.Fields[timeFields[0]]
+	if timeField.Type() == data.FieldTypeNullableTime {
+		newValues := []time.Time{}
+		for i := 0; i < timeField.Len(); i++ {
+			val, ok := timeField.ConcreteAt(i)
+			if !ok {
+				return fmt.Errorf("can not convert to wide series, input has null time values")
+			}
+			newValues = append(newValues, val.(time.Time))
+		}
+		newField := data.NewField(timeField.Name, timeField.Labels, newValues)
+		newField.Config = timeField.Config
+		frame.Fields[timeFields[0]] = newField
+
+		// LongToMulti requires the meta to be set for the frame
+		frame.Meta.Type = data.FrameTypeTimeSeriesLong
+		frame.Meta.TypeVersion = data.FrameTypeVersion{0, 1}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/sqlds/v3"
+)
+
+// ErrorReadOnly is returned when a query is rejected because the datasource is read-only and the
+// query contains a statement other than SELECT.
+var ErrorReadOnly = errors.New("the datasource is read-only and only allows SELECT statements")
+
+// checkReadOnly parses query with DuckDB's own parser and rejects it unless every statement is a
+// SELECT (or a DESCRIBE, SHOW, SUMMARIZE or VALUES, which DuckDB rewrites into a SELECT).
+func checkReadOnly(ctx context.Context, query string) error {
+	serialized, err := serializeStatements(ctx, query)
+	if err != nil {
+		return sqlds.PluginError(fmt.Errorf("could not parse the query: %w", err))
+	}
+	if !serialized.Error {
+		return nil
+	}
+	if !serialized.notSelect() {
+		return sqlds.DownstreamError(fmt.Errorf("%w: %s", sqlds.ErrorQuery, serialized.ErrorMessage))
+	}
+	return sqlds.DownstreamError(fmt.Errorf("%w: %s", ErrorReadOnly, describeRejectedStatement(ctx, query)))
+}
+
+// describeRejectedStatement names the first statement of query that is not a SELECT. The statements
+// are told apart in a single pass, and a query holding one statement is described from its own
+// text, whose serialization already failed.
+func describeRejectedStatement(ctx context.Context, query string) string {
+	statements, err := extractStatements(ctx, query)
+	if err != nil {
+		return "the query contains a statement that is not a SELECT"
+	}
+	for i, statement := range statements {
+		if ctx.Err() != nil {
+			break
+		}
+		if len(statements) > 1 {
+			serialized, err := serializeStatements(ctx, statement.Text)
+			if err != nil || !serialized.notSelect() {
+				continue
+			}
+		}
+		which := "the query"
+		if len(statements) > 1 {
+			which = fmt.Sprintf("statement %d of the query", i+1)
+		}
+		if statementType := statementType(ctx, statement.Text); statementType != "" {
+			return fmt.Sprintf("%s has statement type %s", which, statementType)
+		}
+		return fmt.Sprintf("%s is not a SELECT", which)
+	}
+	return "the query contains a statement that is not a SELECT"
+}
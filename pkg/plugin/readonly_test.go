@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readonly.duckdb")
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE metrics AS SELECT 1 AS v"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err = ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"` + path + `", "readOnly": true}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sql      string
+		rejected string
+	}{
+		{"SELECT * FROM metrics", ""},
+		{"WITH m AS (SELECT v FROM metrics) SELECT * FROM m", ""},
+		{"DESCRIBE metrics", ""},
+		{"SELECT 'DROP TABLE metrics; --' AS s; SELECT v FROM metrics", ""},
+		{"DROP TABLE metrics", "the query has statement type DROP"},
+		{"COPY (SELECT * FROM metrics) TO 'out.csv'", "the query has statement type COPY"},
+		{"ATTACH 'other.duckdb'", "the query has statement type ATTACH"},
+		{"SELECT ';' AS s; /* ; */ DELETE FROM metrics", "statement 2 of the query has statement type DELETE"},
+		{"-- INSERT\nDROP TABLE metrics", "the query has statement type DROP"},
+		{"BEGIN; DROP TABLE metrics; COMMIT", "statement 1 of the query has statement type TRANSACTION"},
+		{"WITH m AS (SELECT 1) INSERT INTO metrics SELECT * FROM m", "the query is not a SELECT"},
+		{"SELECT '" + strings.Repeat(";", 3000) + "' AS s; DELETE FROM metrics", "statement 2 of the query has statement type DELETE"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.sql, func(t *testing.T) {
+			model, _ := json.Marshal(map[string]any{"rawSql": tc.sql, "format": 1})
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{{RefID: "A", JSON: model}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := resp.Responses["A"]
+			if tc.rejected == "" {
+				if res.Error != nil {
+					t.Fatal(res.Error)
+				}
+				return
+			}
+			if !errors.Is(res.Error, ErrorReadOnly) || !strings.Contains(res.Error.Error(), tc.rejected) {
+				t.Errorf("expected the query to be rejected with %q, got: %v", tc.rejected, res.Error)
+			}
+		})
+	}
+
+	model, _ := json.Marshal(map[string]any{"rawSql": "SELECT current_setting('access_mode')::VARCHAR AS mode", "format": 1})
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: model}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := resp.Responses["A"]; res.Error != nil {
+		t.Fatal(res.Error)
+	} else if mode, _ := res.Frames[0].Fields[0].ConcreteAt(0); mode != "read_only" {
+		t.Errorf("expected the file to be opened read-only, got access mode %v", mode)
+	}
+}
+
+func TestExtractStatements(t *testing.T) {
+	tests := []struct {
+		sql        string
+		statements []string
+	}{
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SELECT 'a;b' AS s; SELECT 2;", []string{"SELECT 'a;b' AS s;", "SELECT 2;"}},
+		{"SELECT E'a\\';' AS s; SELECT 2", []string{"SELECT E'a\\';' AS s;", "SELECT 2"}},
+		{"SELECT $tag$;$tag$ AS s; SELECT 2", []string{"SELECT $tag$;$tag$ AS s;", "SELECT 2"}},
+		{"SELECT 1 /* /* ; */ ; */; SELECT \";\" FROM t", []string{"SELECT 1 /* /* ; */ ; */;", "SELECT \";\" FROM t"}},
+		{"  SELECT 1;; -- ;\n SELECT 2 -- ;", []string{"SELECT 1;", "-- ;\n SELECT 2 -- ;"}},
+	}
+	for _, tc := range tests {
+		statements, err := extractStatements(context.Background(), tc.sql)
+		if err != nil {
+			t.Errorf("%q: %v", tc.sql, err)
+			continue
+		}
+		var texts []string
+		for _, statement := range statements {
+			if !strings.HasPrefix(tc.sql[statement.Offset:], statement.Text) {
+				t.Errorf("%q: statement %q is not at offset %d", tc.sql, statement.Text, statement.Offset)
+			}
+			texts = append(texts, statement.Text)
+		}
+		if strings.Join(texts, "|") != strings.Join(tc.statements, "|") {
+			t.Errorf("%q: expected statements %q, got %q", tc.sql, tc.statements, texts)
+		}
+	}
+
+	if _, err := extractStatements(context.Background(), "SELECT 'a;b"); err == nil {
+		t.Error("expected an unterminated string to be rejected")
+	}
+}
+
+func TestExtractStatementsManySemicolons(t *testing.T) {
+	query := "SELECT '" + strings.Repeat(";", 20000) + "' AS s; SELECT 2"
+	start := time.Now()
+	statements, err := extractStatements(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statements) != 2 || statements[1].Text != "SELECT 2" {
+		t.Errorf("expected two statements, got %q", statements)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the statements to be extracted in a single pass, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := extractStatements(ctx, "SELECT 1; SELECT 2"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled extraction to stop, got %v", err)
+	}
+}
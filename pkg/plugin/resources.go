@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/sqlds/v3"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+// ErrorMemoryPressure is returned when a query is rejected because DuckDB is using more memory than
+// the configured watermark allows.
+var ErrorMemoryPressure = errors.New("DuckDB memory usage is above the watermark")
+
+// resourceOptions returns the DuckDB configuration options that bound the resources the database
+// may use. They are passed in the DSN, so that they apply from the moment the database is opened.
+func resourceOptions(config *models.PluginSettings) (url.Values, error) {
+	options := url.Values{}
+	if config.Threads < 0 {
+		return nil, &ConfigError{"Invalid threads: must not be negative"}
+	}
+	if config.MemoryWatermark < 0 || config.MemoryWatermark > 100 {
+		return nil, &ConfigError{"Invalid memory watermark: must be a percentage between 0 and 100"}
+	}
+	if memoryLimit := strings.TrimSpace(config.MemoryLimit); memoryLimit != "" {
+		options.Set("memory_limit", memoryLimit)
+	}
+	if config.Threads > 0 {
+		options.Set("threads", strconv.Itoa(config.Threads))
+	}
+	if tempDirectory := strings.TrimSpace(config.TempDirectory); tempDirectory != "" {
+		options.Set("temp_directory", tempDirectory)
+	}
+	if maxTempSize := strings.TrimSpace(config.MaxTempDirectorySize); maxTempSize != "" {
+		options.Set("max_temp_directory_size", maxTempSize)
+	}
+	return options, nil
+}
+
+// memoryGuard rejects queries while the memory DuckDB has allocated is above a share of its
+// memory limit, so that a datasource under pressure fails fast instead of spilling or running
+// out of memory halfway through a query.
+type memoryGuard struct {
+	watermark float64
+}
+
+// newMemoryGuard returns the memory guard configured in config, or nil when no watermark is set.
+func newMemoryGuard(config *models.PluginSettings) *memoryGuard {
+	if config.MemoryWatermark <= 0 {
+		return nil
+	}
+	return &memoryGuard{watermark: float64(config.MemoryWatermark) / 100}
+}
+
+// Check reads the memory usage reported by duckdb_memory() on conn and returns ErrorMemoryPressure
+// when it is above the watermark.
+func (g *memoryGuard) Check(ctx context.Context, conn *sql.Conn) error {
+	var (
+		setting string
+		used    int64
+	)
+	err := conn.QueryRowContext(ctx, "SELECT current_setting('memory_limit')::VARCHAR, coalesce(sum(memory_usage_bytes), 0)::BIGINT FROM duckdb_memory()").Scan(&setting, &used)
+	if err != nil {
+		return err
+	}
+	limit, err := parseSize(setting)
+	if err != nil || limit <= 0 {
+		backend.Logger.Debug("Could not read the DuckDB memory limit, skipping the memory check", "memory_limit", setting, "error", err)
+		return nil
+	}
+	if float64(used) > g.watermark*float64(limit) {
+		return sqlds.DownstreamError(fmt.Errorf("%w: %s of %s in use, the watermark is %.0f%%", ErrorMemoryPressure, formatSize(used), setting, g.watermark*100))
+	}
+	return nil
+}
+
+var sizePattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([A-Za-z]*)$`)
+
+var sizeUnits = map[string]float64{
+	"":      1,
+	"b":     1,
+	"bytes": 1,
+	"kb":    1e3,
+	"mb":    1e6,
+	"gb":    1e9,
+	"tb":    1e12,
+	"kib":   1 << 10,
+	"mib":   1 << 20,
+	"gib":   1 << 30,
+	"tib":   1 << 40,
+}
+
+// parseSize parses a size the way DuckDB prints it, such as "953.6 MiB" or "4GB", into bytes.
+func parseSize(s string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	unit, ok := sizeUnits[strings.ToLower(m[2])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit %q", m[2])
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(v * unit), nil
+}
+
+func formatSize(bytes int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(bytes)/(1<<20))
+}
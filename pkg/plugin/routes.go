@@ -0,0 +1,133 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+// customRoutes returns the resource routes served next to the /schemas, /tables and /columns
+// routes of sqlds.
+func (d *SQLDataSourceWrapper) customRoutes() map[string]func(http.ResponseWriter, *http.Request) {
+	return map[string]func(http.ResponseWriter, *http.Request){
+		"/catalog":     d.handleCatalog,
+		"/functions":   d.handleFunctions,
+		"/file-schema": d.handleFileSchema,
+		"/validate":    d.handleValidate,
+		"/preview":     d.handlePreview,
+	}
+}
+
+// queryResource runs a metadata query for a resource route on the default connection, calling
+// scan for every row.
+func (d *SQLDataSourceWrapper) queryResource(ctx context.Context, query string, args []any, scan func(rows *sql.Rows) error) error {
+	timeout := d.DriverSettings().Timeout
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, release, err := d.resourceConn(ctx, &sqlutil.Query{}, timeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return queryError(ctx, timeout, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// resourceConn returns a connection for the queries a resource route runs for q. Like panel
+// queries, they wait for a slot of the admission queue and are rejected while memory usage is
+// above the watermark. release closes the connection and frees the slot.
+func (d *SQLDataSourceWrapper) resourceConn(ctx context.Context, q *sqlutil.Query, timeout time.Duration) (conn *sql.Conn, release func(), err error) {
+	db, err := d.GetDBFromQuery(ctx, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	releaseSlot := func() {}
+	if d.admission != nil {
+		releaseSlot, err = d.admission.Acquire(ctx, classDashboard)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	conn, err = db.Conn(ctx)
+	if err != nil {
+		releaseSlot()
+		return nil, nil, queryError(ctx, timeout, err)
+	}
+	release = func() {
+		if err := conn.Close(); err != nil && !errors.Is(err, sql.ErrConnDone) {
+			backend.Logger.Error(err.Error())
+		}
+		releaseSlot()
+	}
+
+	if d.memory != nil {
+		if err := d.memory.Check(ctx, conn); err != nil {
+			release()
+			if errors.Is(err, ErrorMemoryPressure) {
+				return nil, nil, err
+			}
+			return nil, nil, queryError(ctx, timeout, err)
+		}
+	}
+	return conn, release, nil
+}
+
+// checkResourceQuery applies the read-only mode and the query policy to a query a resource route
+// runs on behalf of the user, like to panel queries.
+func (d *SQLDataSourceWrapper) checkResourceQuery(ctx context.Context, rawSQL string) error {
+	if d.readOnly {
+		if err := checkReadOnly(ctx, rawSQL); err != nil {
+			return err
+		}
+	}
+	if d.policy != nil {
+		if err := d.policy.Check(ctx, rawSQL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryErrorStatus returns the status of a resource response reporting that a query failed.
+func queryErrorStatus(err error) int {
+	if errors.Is(err, ErrorPolicy) || errors.Is(err, ErrorReadOnly) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// sendResource writes v as the JSON body of a resource response.
+func sendResource(rw http.ResponseWriter, v any) {
+	rw.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		backend.Logger.Error(err.Error())
+	}
+}
+
+// sendResourceError writes err as the body of a resource response with status, the way sqlds
+// reports the errors of its own routes.
+func sendResourceError(rw http.ResponseWriter, status int, err error) {
+	rw.WriteHeader(status)
+	if _, err := rw.Write([]byte(err.Error())); err != nil {
+		backend.Logger.Error(err.Error())
+	}
+}
@@ -0,0 +1,28 @@
+package plugin
+
+import (
+	"strings"
+
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+// sandboxQueries returns the statements that confine queries once the boot queries and InitSql
+// have run: files outside of the allowed directories and remote URLs can no longer be read, and
+// the configuration is locked so that queries cannot lift the restrictions again.
+func sandboxQueries(config *models.PluginSettings) []string {
+	var queries []string
+	var allowed []string
+	for _, dir := range config.AllowedDirectories {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			allowed = append(allowed, "'"+strings.ReplaceAll(dir, "'", "''")+"'")
+		}
+	}
+	if len(allowed) > 0 {
+		// Must be set while external access is still enabled.
+		queries = append(queries, "SET allowed_directories = ["+strings.Join(allowed, ", ")+"];")
+	}
+	return append(queries,
+		"SET enable_external_access = false;",
+		"SET lock_configuration = true;",
+	)
+}
@@ -0,0 +1,133 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/sqlds/v3"
+)
+
+const (
+	defaultSampleRows = 10
+	maxSampleRows     = 1000
+	// fileSchemaTimeout bounds the inference of a file schema, remote globs can match many files.
+	fileSchemaTimeout = 10 * time.Second
+)
+
+// fileReaderPattern matches the names of the table functions a file schema may be read with.
+var fileReaderPattern = regexp.MustCompile(`^read_[a-z0-9_]+$`)
+
+// fileSchemaRequest is the body of the /file-schema resource.
+type fileSchemaRequest struct {
+	// Path is a local path, URL or glob.
+	Path string `json:"path"`
+	// Reader is the table function reading the files, like read_csv. By default DuckDB picks it
+	// from the extension.
+	Reader string `json:"reader,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type fileSchemaColumn struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+}
+
+// handleFileSchema infers the columns of the files at a path or glob and returns them with a
+// sample of their rows. The files are read by a query that goes through the same read-only and
+// policy checks as panel queries, and the sandbox applies to it.
+func (d *SQLDataSourceWrapper) handleFileSchema(rw http.ResponseWriter, req *http.Request) {
+	var options fileSchemaRequest
+	if err := json.NewDecoder(req.Body).Decode(&options); err != nil {
+		sendResourceError(rw, http.StatusBadRequest, fmt.Errorf("%w: %v", sqlds.ErrorWrongOptions, err))
+		return
+	}
+	q, err := fileSchemaQuery(&options)
+	if err != nil {
+		sendResourceError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), fileSchemaTimeout)
+	defer cancel()
+	columns, sample, err := d.inferFileSchema(ctx, q)
+	if err != nil {
+		sendResourceError(rw, queryErrorStatus(err), err)
+		return
+	}
+	sendResource(rw, map[string]any{
+		"query":   q.RawSQL,
+		"columns": columns,
+		"sample":  sample,
+	})
+}
+
+// fileSchemaQuery returns the query sampling the files of options.
+func fileSchemaQuery(options *fileSchemaRequest) (*sqlutil.Query, error) {
+	path := strings.TrimSpace(options.Path)
+	if path == "" {
+		return nil, fmt.Errorf("%w: the path option is required", sqlds.ErrorWrongOptions)
+	}
+	limit := options.Limit
+	if limit == 0 {
+		limit = defaultSampleRows
+	}
+	if limit < 0 || limit > maxSampleRows {
+		return nil, fmt.Errorf("%w: the limit must be between 1 and %d", sqlds.ErrorWrongOptions, maxSampleRows)
+	}
+
+	source := "'" + strings.ReplaceAll(path, "'", "''") + "'"
+	if options.Reader != "" {
+		reader := strings.ToLower(options.Reader)
+		if !fileReaderPattern.MatchString(reader) {
+			return nil, fmt.Errorf("%w: the reader must be a read_ table function, got %q", sqlds.ErrorWrongOptions, options.Reader)
+		}
+		source = reader + "(" + source + ")"
+	}
+	return &sqlutil.Query{
+		RefID:  "schema",
+		RawSQL: fmt.Sprintf("SELECT * FROM %s LIMIT %d", source, limit),
+	}, nil
+}
+
+// inferFileSchema checks and runs the sample query q, and describes its columns.
+func (d *SQLDataSourceWrapper) inferFileSchema(ctx context.Context, q *sqlutil.Query) ([]fileSchemaColumn, *data.Frame, error) {
+	if err := d.checkResourceQuery(ctx, q.RawSQL); err != nil {
+		return nil, nil, err
+	}
+
+	describe := *q
+	describe.RawSQL = "DESCRIBE " + q.RawSQL
+	described, err := d.runQuery(ctx, &describe)
+	if err != nil {
+		return nil, nil, err
+	}
+	nameIdx := findField(described, []string{"column_name"}, nil)
+	typeIdx := findField(described, []string{"column_type"}, nil)
+	nullIdx := findField(described, []string{"null"}, nil)
+	if nameIdx < 0 || typeIdx < 0 {
+		return nil, nil, fmt.Errorf("unexpected DESCRIBE result")
+	}
+	columns := make([]fileSchemaColumn, described.Rows())
+	for i := range columns {
+		columns[i] = fileSchemaColumn{
+			Name:     stringValue(described.Fields[nameIdx], i),
+			Type:     stringValue(described.Fields[typeIdx], i),
+			Nullable: nullIdx < 0 || stringValue(described.Fields[nullIdx], i) != "NO",
+		}
+	}
+
+	sample, err := d.runQuery(ctx, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	sample.Name = q.RefID
+	return columns, sample, nil
+}
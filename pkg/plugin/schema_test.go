@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestFileSchema(t *testing.T) {
+	dir := t.TempDir()
+	for i, name := range []string{"a.csv", "b.csv"} {
+		content := "id,name,score\n"
+		for j := 0; j < 20; j++ {
+			content += fmt.Sprintf("%d,row %d,%d.5\n", i*100+j, j, j)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newDatasource := func(settings map[string]any) *SQLDataSourceWrapper {
+		t.Helper()
+		settings["path"] = ""
+		encoded, _ := json.Marshal(settings)
+		ds := NewDatasource(&DuckDBDriver{Initialized: false})
+		if _, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: encoded}); err != nil {
+			t.Fatal(err)
+		}
+		return ds
+	}
+
+	ds := newDatasource(map[string]any{})
+	body, _ := json.Marshal(map[string]any{"path": filepath.Join(dir, "*.csv"), "limit": 3})
+	resp := callResource(t, ds, "file-schema", body)
+	if resp.Status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Status, resp.Body)
+	}
+	var schema struct {
+		Columns []fileSchemaColumn `json:"columns"`
+		Sample  *data.Frame        `json:"sample"`
+	}
+	if err := json.Unmarshal(resp.Body, &schema); err != nil {
+		t.Fatal(err)
+	}
+	expected := []fileSchemaColumn{
+		{Name: "id", Type: "BIGINT", Nullable: true},
+		{Name: "name", Type: "VARCHAR", Nullable: true},
+		{Name: "score", Type: "DOUBLE", Nullable: true},
+	}
+	if !reflect.DeepEqual(schema.Columns, expected) {
+		t.Errorf("expected %+v, got %+v", expected, schema.Columns)
+	}
+	if schema.Sample == nil || schema.Sample.Rows() != 3 || len(schema.Sample.Fields) != 3 {
+		t.Errorf("expected a sample of 3 rows, got %v", schema.Sample)
+	}
+
+	tests := []struct {
+		name     string
+		settings map[string]any
+		options  map[string]any
+		status   int
+		message  string
+	}{
+		{"reader", nil, map[string]any{"path": filepath.Join(dir, "a.csv"), "reader": "read_csv"}, http.StatusOK, ""},
+		{"no path", nil, map[string]any{}, http.StatusBadRequest, "the path option is required"},
+		{"limit", nil, map[string]any{"path": dir, "limit": 5000}, http.StatusBadRequest, "the limit must be between 1 and 1000"},
+		{"reader injection", nil, map[string]any{"path": dir, "reader": "glob('/') , read_csv"}, http.StatusBadRequest, "the reader must be a read_ table function"},
+		{"missing file", nil, map[string]any{"path": filepath.Join(dir, "missing.csv")}, http.StatusBadRequest, "No files found"},
+		{"denied reader", map[string]any{"deniedTableFunctions": []string{"read_csv"}}, map[string]any{"path": filepath.Join(dir, "a.csv")}, http.StatusForbidden, "table function read_csv is not allowed"},
+		{"sandbox", map[string]any{"sandbox": true}, map[string]any{"path": filepath.Join(dir, "a.csv")}, http.StatusBadRequest, "Permission Error"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ds := ds
+			if tc.settings != nil {
+				ds = newDatasource(tc.settings)
+			}
+			body, _ := json.Marshal(tc.options)
+			resp := callResource(t, ds, "file-schema", body)
+			if resp.Status != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, resp.Status, resp.Body)
+			}
+			if !strings.Contains(string(resp.Body), tc.message) {
+				t.Errorf("expected %q in %s", tc.message, resp.Body)
+			}
+		})
+	}
+}
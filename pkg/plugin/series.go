@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+// legendLabel matches the {{label}} placeholders of a legend format.
+var legendLabel = regexp.MustCompile(`\{\{\s*(.+?)\s*\}\}`)
+
+// selectSeriesColumns narrows the columns of a time series result to the label and value columns
+// the query lists, before the result is split into series. By default every text column is a
+// label and every other column a value. Listed label columns that are not text are converted to
+// text, so numeric ids can split series too.
+func selectSeriesColumns(frame *data.Frame, model *models.QueryModel) error {
+	if len(model.LabelColumns) == 0 && len(model.ValueColumns) == 0 {
+		return nil
+	}
+	for _, name := range append(slices.Clone(model.LabelColumns), model.ValueColumns...) {
+		if _, idx := frame.FieldByName(name); idx < 0 {
+			return fmt.Errorf("the column %q is not in the result", name)
+		}
+	}
+
+	fields := make([]*data.Field, 0, len(frame.Fields))
+	timeSeen := false
+	for _, field := range frame.Fields {
+		switch {
+		case slices.Contains(model.LabelColumns, field.Name):
+			if !isStringField(field) {
+				field = labelField(field)
+			}
+		case slices.Contains(model.ValueColumns, field.Name):
+			if !field.Type().Numeric() && field.Type() != data.FieldTypeBool && field.Type() != data.FieldTypeNullableBool {
+				return fmt.Errorf("the value column %q must be a number, got %s", field.Name, field.Type().ItemTypeString())
+			}
+		case field.Type().Time() && !timeSeen:
+			timeSeen = true
+		case isStringField(field):
+			if len(model.LabelColumns) > 0 {
+				continue
+			}
+		default:
+			if len(model.ValueColumns) > 0 || field.Type().Time() {
+				continue
+			}
+		}
+		fields = append(fields, field)
+	}
+	frame.Fields = fields
+	return nil
+}
+
+// labelField converts the values of field to text.
+func labelField(field *data.Field) *data.Field {
+	values := make([]*string, field.Len())
+	for i := range values {
+		if _, ok := field.ConcreteAt(i); ok {
+			value := stringValue(field, i)
+			values[i] = &value
+		}
+	}
+	return data.NewField(field.Name, field.Labels, values)
+}
+
+// setDisplayNames names the series of frames after the legend format, replacing {{label}} with
+// the value of the label and {{__name__}} with the name of the value column. Labels a series does
+// not have are left empty.
+func setDisplayNames(frames data.Frames, legend string) {
+	if legend == "" {
+		return
+	}
+	for _, frame := range frames {
+		for _, field := range frame.Fields {
+			if field.Type().Time() {
+				continue
+			}
+			name := legendLabel.ReplaceAllStringFunc(legend, func(placeholder string) string {
+				label := legendLabel.FindStringSubmatch(placeholder)[1]
+				if label == "__name__" {
+					return field.Name
+				}
+				return field.Labels[label]
+			})
+			if field.Config == nil {
+				field.Config = &data.FieldConfig{}
+			}
+			field.Config.DisplayNameFromDS = name
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+func TestSeriesOptions(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "initSql": "CREATE TABLE cpu AS SELECT TIMESTAMP '2024-01-01' + to_minutes(i // 4) AS ts, ['a', 'b'][i % 2 + 1] AS host, 'eu' AS region, i % 4 // 2 AS core, i::DOUBLE AS usage, 100 - i AS idle FROM range(0, 8) t(i);"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(model map[string]any) data.Frames {
+		t.Helper()
+		model["rawSql"] = "SELECT ts, host, region, core, usage, idle FROM cpu ORDER BY ts"
+		encoded, _ := json.Marshal(model)
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: encoded}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Responses["A"].Error != nil {
+			t.Fatal(resp.Responses["A"].Error)
+		}
+		return resp.Responses["A"].Frames
+	}
+	displayNames := func(frames data.Frames) []string {
+		var names []string
+		for _, frame := range frames {
+			for _, field := range frame.Fields {
+				if !field.Type().Time() {
+					names = append(names, field.Config.DisplayNameFromDS)
+				}
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, format := range []sqlutil.FormatQueryOption{sqlutil.FormatOptionTimeSeries, sqlutil.FormatOptionMulti} {
+		frames := query(map[string]any{
+			"format":       format,
+			"labelColumns": []string{"host", "core"},
+			"valueColumns": []string{"usage"},
+			"legendFormat": "{{__name__}} on {{host}}/{{core}} {{missing}}",
+		})
+		want := []string{"usage on a/0 ", "usage on a/1 ", "usage on b/0 ", "usage on b/1 "}
+		if got := displayNames(frames); len(got) != len(want) || got[0] != want[0] || got[3] != want[3] {
+			t.Errorf("format %d: expected series %v, got %v", format, want, got)
+		}
+		for _, frame := range frames {
+			for _, field := range frame.Fields {
+				if field.Labels["region"] != "" {
+					t.Errorf("format %d: expected region not to be a label, got %v", format, field.Labels)
+				}
+			}
+		}
+	}
+
+	if frames := query(map[string]any{"legendFormat": "{{host}}"}); len(displayNames(frames)) != 6 {
+		t.Errorf("expected the usage, idle and core series of both hosts by default, got %v", displayNames(frames))
+	}
+
+	encoded, _ := json.Marshal(map[string]any{"rawSql": "SELECT ts, usage FROM cpu", "labelColumns": []string{"hostname"}})
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: encoded}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Responses["A"].Error == nil {
+		t.Error("expected a missing label column to be rejected")
+	}
+}
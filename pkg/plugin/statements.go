@@ -0,0 +1,347 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	duckdb "github.com/duckdb/duckdb-go/v2"
+	"github.com/duckdb/duckdb-go/v2/mapping"
+)
+
+// parser gives access to DuckDB's own statement extraction and serialization. It is backed by
+// private in-memory databases without external access that are only ever used to parse SQL, never
+// to run it, so it is shared by every datasource instance.
+var parser = &statementParser{}
+
+type statementParser struct {
+	once sync.Once
+	mu   sync.Mutex
+	db   mapping.Database
+	conn mapping.Connection
+	// sqlDB runs json_serialize_sql, which needs a result set the C mapping does not read easily.
+	sqlDB *sql.DB
+	err   error
+}
+
+func (p *statementParser) open() error {
+	p.once.Do(func() {
+		var config mapping.Config
+		if mapping.CreateConfig(&config) == mapping.StateError {
+			p.err = errors.New("could not create parser config")
+			return
+		}
+		defer mapping.DestroyConfig(&config)
+		if mapping.SetConfig(config, "enable_external_access", "false") == mapping.StateError {
+			p.err = errors.New("could not configure parser database")
+			return
+		}
+
+		var errMsg string
+		if mapping.OpenExt("", &p.db, config, &errMsg) == mapping.StateError {
+			p.err = fmt.Errorf("could not open parser database: %s", errMsg)
+			return
+		}
+		if mapping.Connect(p.db, &p.conn) == mapping.StateError {
+			mapping.Close(&p.db)
+			p.err = errors.New("could not connect to parser database")
+			return
+		}
+
+		connector, err := duckdb.NewConnector("?enable_external_access=false", nil)
+		if err != nil {
+			p.err = fmt.Errorf("could not open parser database: %w", err)
+			return
+		}
+		p.sqlDB = sql.OpenDB(connector)
+	})
+	return p.err
+}
+
+// countStatements returns the number of statements DuckDB extracts from query. Statement
+// boundaries are found by DuckDB's parser, so semicolons inside strings, quoted identifiers or
+// comments do not split a statement.
+func countStatements(query string) (int, error) {
+	if err := parser.open(); err != nil {
+		return 0, err
+	}
+
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+
+	var stmts mapping.ExtractedStatements
+	defer mapping.DestroyExtracted(&stmts)
+	count := mapping.ExtractStatements(parser.conn, query, &stmts)
+	if count == 0 {
+		if errMsg := mapping.ExtractStatementsError(stmts); errMsg != "" {
+			return 0, errors.New(errMsg)
+		}
+	}
+	return int(count), nil
+}
+
+// errStatementBoundaries is returned for queries whose statements DuckDB's parser extracts, but
+// whose text cannot be split into those statements.
+var errStatementBoundaries = errors.New("could not tell the statements of the query apart")
+
+// statement is the text of one statement of a query.
+type statement struct {
+	Text string
+	// Offset is the byte offset of Text in the query.
+	Offset int
+}
+
+// extractStatements returns the text of each statement of query. DuckDB's parser extracts the
+// statements of a query but does not say where they are in its text, so the query is split in a
+// single pass at the semicolons that are outside strings, quoted identifiers and comments, and
+// DuckDB's parser checks the split: each part must hold a single statement (or none) and together
+// they must hold the statements of the whole query. Queries whose text does not split into exactly
+// those statements are rejected with errStatementBoundaries.
+func extractStatements(ctx context.Context, query string) ([]statement, error) {
+	total, err := countStatements(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []statement
+	start := 0
+	for _, end := range append(statementEnds(query), len(query)) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if end == start {
+			continue
+		}
+		count, err := countStatements(query[start:end])
+		if err != nil || count > 1 {
+			return nil, errStatementBoundaries
+		}
+		if count == 1 {
+			// Empty statements are skipped by DuckDB, they are left out of the text.
+			text := strings.TrimLeftFunc(query[start:end], func(r rune) bool { return r == ';' || unicode.IsSpace(r) })
+			statements = append(statements, statement{Text: strings.TrimRightFunc(text, unicode.IsSpace), Offset: end - len(text)})
+		}
+		start = end
+	}
+	if len(statements) != total {
+		return nil, errStatementBoundaries
+	}
+	return statements, nil
+}
+
+// statementEnds returns the byte offsets just past the semicolons of query that end a statement,
+// following the lexical rules of DuckDB: single-quoted strings (with backslash escapes after E),
+// dollar-quoted strings, double-quoted identifiers, line comments and nested block comments.
+func statementEnds(query string) []int {
+	var ends []int
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == ';':
+			ends = append(ends, i+1)
+		case c == '\'':
+			escapes := i > 0 && (query[i-1] == 'E' || query[i-1] == 'e') && (i == 1 || !isIdentifierByte(query[i-2]))
+			i = quotedEnd(query, i, '\'', escapes)
+		case c == '"':
+			i = quotedEnd(query, i, '"', false)
+		case strings.HasPrefix(query[i:], "--") || strings.HasPrefix(query[i:], "/*"):
+			i = commentEnd(query, i) - 1
+		case c == '$' && (i == 0 || !isIdentifierByte(query[i-1])):
+			tag := i + 1
+			for tag < len(query) && isIdentifierByte(query[tag]) && (tag > i+1 || query[tag] < '0' || query[tag] > '9') {
+				tag++
+			}
+			if tag < len(query) && query[tag] == '$' {
+				delimiter := query[i : tag+1]
+				if end := strings.Index(query[tag+1:], delimiter); end >= 0 {
+					i = tag + end + len(delimiter)
+				} else {
+					i = len(query)
+				}
+			}
+		}
+	}
+	return ends
+}
+
+// commentEnd returns the offset just past the line comment or the nested block comment starting
+// at start.
+func commentEnd(text string, start int) int {
+	if strings.HasPrefix(text[start:], "--") {
+		if end := strings.IndexByte(text[start:], '\n'); end >= 0 {
+			return start + end
+		}
+		return len(text)
+	}
+	depth := 1
+	i := start + 2
+	for ; i < len(text) && depth > 0; i++ {
+		if strings.HasPrefix(text[i:], "/*") {
+			depth++
+			i++
+		} else if strings.HasPrefix(text[i:], "*/") {
+			depth--
+			i++
+		}
+	}
+	return i
+}
+
+// quotedEnd returns the offset of the quote closing the string or identifier opened at start. A
+// doubled quote is part of the text, as is a quote after a backslash when escapes is set.
+func quotedEnd(query string, start int, quote byte, escapes bool) int {
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if escapes {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return len(query)
+}
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c >= 0x80 || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// statementTypes names the statement types of DuckDB.
+var statementTypes = map[mapping.StatementType]string{
+	mapping.StatementTypeSelect:      "SELECT",
+	mapping.StatementTypeInsert:      "INSERT",
+	mapping.StatementTypeUpdate:      "UPDATE",
+	mapping.StatementTypeExplain:     "EXPLAIN",
+	mapping.StatementTypeDelete:      "DELETE",
+	mapping.StatementTypePrepare:     "PREPARE",
+	mapping.StatementTypeCreate:      "CREATE",
+	mapping.StatementTypeExecute:     "EXECUTE",
+	mapping.StatementTypeAlter:       "ALTER",
+	mapping.StatementTypeTransaction: "TRANSACTION",
+	mapping.StatementTypeCopy:        "COPY",
+	mapping.StatementTypeAnalyze:     "ANALYZE",
+	mapping.StatementTypeVariableSet: "VARIABLE_SET",
+	mapping.StatementTypeCreateFunc:  "CREATE_FUNC",
+	mapping.StatementTypeDrop:        "DROP",
+	mapping.StatementTypeExport:      "EXPORT",
+	mapping.StatementTypePragma:      "PRAGMA",
+	mapping.StatementTypeVacuum:      "VACUUM",
+	mapping.StatementTypeCall:        "CALL",
+	mapping.StatementTypeSet:         "SET",
+	mapping.StatementTypeLoad:        "LOAD",
+	mapping.StatementTypeRelation:    "RELATION",
+	mapping.StatementTypeExtension:   "EXTENSION",
+	mapping.StatementTypeLogicalPlan: "LOGICAL_PLAN",
+	mapping.StatementTypeAttach:      "ATTACH",
+	mapping.StatementTypeDetach:      "DETACH",
+	mapping.StatementTypeMulti:       "MULTI",
+}
+
+// keywordTypes are the statement types of statements that DuckDB can only prepare once the tables
+// or files they refer to exist, by the keyword the statements start with.
+var keywordTypes = map[string]string{
+	"INSERT":  "INSERT",
+	"UPDATE":  "UPDATE",
+	"DELETE":  "DELETE",
+	"COPY":    "COPY",
+	"CREATE":  "CREATE",
+	"ALTER":   "ALTER",
+	"DROP":    "DROP",
+	"EXPORT":  "EXPORT",
+	"IMPORT":  "PRAGMA",
+	"PRAGMA":  "PRAGMA",
+	"CALL":    "CALL",
+	"EXPLAIN": "EXPLAIN",
+}
+
+// keywordProbe is prepended to a statement to find its first keyword: no statement can follow it,
+// so DuckDB reports a syntax error at the first token of the statement, comments skipped.
+const keywordProbe = "SELECT 1 AS probe "
+
+// statementType names the type of a single statement that is not a SELECT. The type is the one
+// DuckDB gives the statement when it can be prepared on the parser database, which knows no tables
+// and cannot access files. Other statements are typed by their first keyword, as DuckDB reads it,
+// when that keyword leads to a single statement type. An empty string is returned otherwise, e.g.
+// for statements starting with common table expressions.
+func statementType(ctx context.Context, text string) string {
+	if err := parser.open(); err != nil {
+		return ""
+	}
+
+	parser.mu.Lock()
+	var stmts mapping.ExtractedStatements
+	count := mapping.ExtractStatements(parser.conn, text, &stmts)
+	var prepared mapping.PreparedStatement
+	if count == 1 && mapping.PrepareExtractedStatement(parser.conn, stmts, 0, &prepared) == mapping.StateSuccess {
+		preparedType := mapping.PreparedStatementType(prepared)
+		mapping.DestroyPrepare(&prepared)
+		mapping.DestroyExtracted(&stmts)
+		parser.mu.Unlock()
+		// PRAGMA statements calling table functions are prepared as SELECT.
+		if name, ok := statementTypes[preparedType]; ok && preparedType != mapping.StatementTypeSelect {
+			return name
+		}
+	} else {
+		mapping.DestroyPrepare(&prepared)
+		mapping.DestroyExtracted(&stmts)
+		parser.mu.Unlock()
+	}
+
+	serialized, err := serializeStatements(ctx, keywordProbe+text)
+	if err != nil || !serialized.Error {
+		return ""
+	}
+	position, err := strconv.Atoi(serialized.ErrorPosition)
+	if err != nil || position < len(keywordProbe) || position > len(keywordProbe)+len(text) {
+		return ""
+	}
+	keyword := text[position-len(keywordProbe):]
+	if end := strings.IndexFunc(keyword, func(r rune) bool { return !unicode.IsLetter(r) }); end >= 0 {
+		keyword = keyword[:end]
+	}
+	return keywordTypes[strings.ToUpper(keyword)]
+}
+
+// serializedSQL is the result of DuckDB's json_serialize_sql. Only SELECT statements (including
+// DESCRIBE, SHOW, SUMMARIZE and VALUES, which DuckDB rewrites into SELECT) can be serialized, any
+// other statement is reported as an error of type "not implemented".
+type serializedSQL struct {
+	Error        bool   `json:"error"`
+	ErrorType    string `json:"error_type"`
+	ErrorMessage string `json:"error_message"`
+	// ErrorPosition is the byte offset of a syntax error in the query, when DuckDB knows it.
+	ErrorPosition string            `json:"position"`
+	Statements    []json.RawMessage `json:"statements"`
+}
+
+// notSelect reports whether serialization failed because a statement is not a SELECT.
+func (s *serializedSQL) notSelect() bool {
+	return s.Error && s.ErrorType == "not implemented"
+}
+
+// serializeStatements parses query with json_serialize_sql.
+func serializeStatements(ctx context.Context, query string) (*serializedSQL, error) {
+	if err := parser.open(); err != nil {
+		return nil, err
+	}
+
+	var raw string
+	if err := parser.sqlDB.QueryRowContext(ctx, "SELECT json_serialize_sql(?::VARCHAR)::VARCHAR", query).Scan(&raw); err != nil {
+		return nil, err
+	}
+	serialized := &serializedSQL{}
+	if err := json.Unmarshal([]byte(raw), serialized); err != nil {
+		return nil, fmt.Errorf("could not read serialized statements: %w", err)
+	}
+	return serialized, nil
+}
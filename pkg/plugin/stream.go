@@ -0,0 +1,315 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+	"github.com/grafana/sqlds/v3"
+	"github.com/motherduckdb/grafana-duckdb-datasource/pkg/models"
+)
+
+const (
+	defaultStreamInterval = time.Second
+	minStreamInterval     = 100 * time.Millisecond
+	// streamSubscribeTTL is how long a stream waits for Grafana to subscribe to its channel.
+	// Queries run outside of panels, like from the query inspector or the API, never subscribe.
+	streamSubscribeTTL = time.Minute
+)
+
+// liveStream is a query whose appended rows are pushed to a Grafana Live channel.
+type liveStream struct {
+	// query is the query with its macros unexpanded, they are expanded up to the current time on
+	// every poll.
+	query    sqlutil.Query
+	column   string
+	interval time.Duration
+	// watermark is the SQL literal of the largest value of column sent so far, or empty.
+	watermark string
+	// files is the glob of a file stream, whose cursor is stored at cursor.
+	files  string
+	cursor string
+	// expires is when the stream is forgotten unless Grafana subscribed to its channel, or zero
+	// once it did.
+	expires time.Time
+}
+
+// streamRegistry holds the streams started by queries, by the path of their channel. Grafana
+// subscribes to the channel once the query returns, and runs one stream per channel however many
+// panels show it. Streams nobody subscribed to within ttl are forgotten.
+type streamRegistry struct {
+	mu              sync.Mutex
+	streams         map[string]*liveStream
+	ttl             time.Duration
+	cursorDirectory string
+}
+
+func newStreamRegistry(config *models.PluginSettings) *streamRegistry {
+	cursorDirectory := config.StreamCursorDirectory
+	if cursorDirectory == "" {
+		cursorDirectory = defaultStreamCursorDirectory()
+	}
+	return &streamRegistry{streams: map[string]*liveStream{}, ttl: streamSubscribeTTL, cursorDirectory: cursorDirectory}
+}
+
+// get returns the stream at path, or nil when there is none.
+func (r *streamRegistry) get(path string) *liveStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stream := r.streams[path]
+	if stream == nil || stream.expired(time.Now()) {
+		return nil
+	}
+	return stream
+}
+
+// subscribe returns the stream at path and keeps it until its channel is no longer run.
+func (r *streamRegistry) subscribe(path string) *liveStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stream := r.streams[path]
+	if stream == nil || stream.expired(time.Now()) {
+		return nil
+	}
+	stream.expires = time.Time{}
+	return stream
+}
+
+// set records the stream of a query at path, to be subscribed to within ttl, and forgets the
+// expired streams. A stream Grafana already runs at path is kept, it serves the channel.
+func (r *streamRegistry) set(path string, stream *liveStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for p, s := range r.streams {
+		if s.expired(now) {
+			delete(r.streams, p)
+		}
+	}
+	if current := r.streams[path]; current != nil && current.expires.IsZero() {
+		return
+	}
+	stream.expires = now.Add(r.ttl)
+	r.streams[path] = stream
+}
+
+func (s *liveStream) expired(now time.Time) bool {
+	return !s.expires.IsZero() && now.After(s.expires)
+}
+
+// remove forgets the stream at path, unless a newer query replaced it in the meantime.
+func (r *streamRegistry) remove(path string, stream *liveStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.streams[path] == stream {
+		delete(r.streams, path)
+	}
+}
+
+// streamPath identifies the stream of a query by its text with the macros unexpanded, so a panel
+// refreshing the query keeps its channel.
+func streamPath(q *sqlutil.Query, options *models.Stream) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s", q.RefID, options.Column, options.Interval, options.Files, q.RawSQL)
+	return "stream/" + hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// startStream runs the macro-expanded query q and returns its rows as they are, with the Live
+// channel the rows appended later are pushed to. template is the same query with its macros
+// unexpanded.
+func (d *SQLDataSourceWrapper) startStream(ctx context.Context, q *sqlutil.Query, template *sqlutil.Query, options *models.Stream) (data.Frames, error) {
+	if err := requireSingleStatement(q.RawSQL, "streaming"); err != nil {
+		return nil, err
+	}
+	interval := defaultStreamInterval
+	if options.Interval != "" {
+		parsed, err := time.ParseDuration(options.Interval)
+		if err != nil || parsed < minStreamInterval {
+			return nil, sqlds.DownstreamError(fmt.Errorf("%w: the stream interval must be a duration of at least %s, got %q", sqlds.ErrorQuery, minStreamInterval, options.Interval))
+		}
+		interval = parsed
+	}
+	if options.Files != "" {
+		return d.startFileStream(ctx, q, template, options, interval)
+	}
+
+	frame, err := d.runQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	column := options.Column
+	if column == "" {
+		if idx := firstUnused(frame, nil, isTimeField); idx >= 0 {
+			column = frame.Fields[idx].Name
+		}
+	}
+	field, _ := frame.FieldByName(column)
+	if field == nil || (!field.Type().Time() && !field.Type().Numeric()) {
+		return nil, sqlds.DownstreamError(fmt.Errorf("%w: streaming queries require a time or sequence column to follow", sqlds.ErrorQuery))
+	}
+
+	stream := &liveStream{
+		query:     *template,
+		column:    column,
+		interval:  interval,
+		watermark: watermark(field),
+	}
+	path := streamPath(template, options)
+	d.streams.set(path, stream)
+
+	frame.Name = q.RefID
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.ExecutedQueryString = q.RawSQL
+	frame.Meta.PreferredVisualization = data.VisTypeGraph
+	frame.Meta.Channel = live.Channel{Scope: live.ScopeDatasource, Namespace: d.settings.UID, Path: path}.String()
+	return data.Frames{frame}, nil
+}
+
+// watermark returns the SQL literal of the largest value of field, or an empty string when it has
+// no values.
+func watermark(field *data.Field) string {
+	largest := -1
+	var largestTime time.Time
+	var largestNumber float64
+	for i := 0; i < field.Len(); i++ {
+		v, ok := field.ConcreteAt(i)
+		if !ok {
+			continue
+		}
+		if ts, ok := v.(time.Time); ok {
+			if largest < 0 || ts.After(largestTime) {
+				largest, largestTime = i, ts
+			}
+			continue
+		}
+		number, _ := field.FloatAt(i)
+		if largest < 0 || number > largestNumber {
+			largest, largestNumber = i, number
+		}
+	}
+	if largest < 0 {
+		return ""
+	}
+	if field.Type().Time() {
+		return "'" + largestTime.UTC().Format(time.RFC3339Nano) + "'"
+	}
+	return stringValue(field, largest)
+}
+
+// SubscribeStream accepts subscriptions to the channels of streams started by queries. Any user
+// presenting the path of a channel may subscribe to it, the query of the stream is checked again
+// for that user, who may not be exempt from the policy like the user who started it.
+func (d *SQLDataSourceWrapper) SubscribeStream(ctx context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	stream := d.streams.get(req.Path)
+	if stream == nil {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	if err := d.checkStreamQuery(backend.WithUser(ctx, req.PluginContext.User), stream); err != nil {
+		backend.Logger.Debug("Denied the subscription to the stream", "path", req.Path, "error", err)
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusPermissionDenied}, nil
+	}
+	if d.streams.subscribe(req.Path) == nil {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK}, nil
+}
+
+// checkStreamQuery applies the read-only mode and the query policy to the query of stream, and to
+// the listing of the files of a file stream, the way handleQuery checks the query starting it.
+func (d *SQLDataSourceWrapper) checkStreamQuery(ctx context.Context, stream *liveStream) error {
+	q := stream.query
+	if stream.files != "" {
+		q.RawSQL = fileStreamQuery(q.RawSQL, stream.files)
+	}
+	rawSQL, err := sqlutil.Interpolate(&q, d.driver.Macros())
+	if err != nil {
+		return fmt.Errorf("%s: %w", "Could not apply macros", err)
+	}
+	if err := d.checkResourceQuery(ctx, rawSQL); err != nil {
+		return err
+	}
+	if stream.files != "" {
+		return d.checkResourceQuery(ctx, streamFilesQuery(stream.files))
+	}
+	return nil
+}
+
+// PublishStream rejects messages from clients, the channels only carry query results.
+func (d *SQLDataSourceWrapper) PublishStream(ctx context.Context, req *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
+
+// RunStream polls the query of the stream at req.Path for rows past the watermark and sends them
+// to the channel until Grafana cancels ctx, when the last subscriber leaves.
+func (d *SQLDataSourceWrapper) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	stream := d.streams.subscribe(req.Path)
+	if stream == nil {
+		return fmt.Errorf("unknown stream %q", req.Path)
+	}
+	defer d.streams.remove(req.Path, stream)
+	if stream.files != "" {
+		return d.runFileStream(ctx, req.Path, stream, sender)
+	}
+
+	query := stream.query
+	after := stream.watermark
+	ticker := time.NewTicker(stream.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		frame, err := d.pollStream(ctx, &query, stream.column, after)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			backend.Logger.Warn("Could not poll the stream", "path", req.Path, "error", err)
+			continue
+		}
+		if frame.Rows() == 0 {
+			continue
+		}
+		field, _ := frame.FieldByName(stream.column)
+		if field != nil {
+			if next := watermark(field); next != "" {
+				after = next
+			}
+		}
+		frame.Name = query.RefID
+		if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+			return err
+		}
+	}
+}
+
+// pollStream runs query for the rows whose column is past the watermark after, with the macros
+// expanded up to the current time. Polls wait for a query slot in runQuery like dashboard queries,
+// so short intervals do not get around the admission limits.
+func (d *SQLDataSourceWrapper) pollStream(ctx context.Context, query *sqlutil.Query, column string, after string) (*data.Frame, error) {
+	q := *query
+	q.TimeRange.To = time.Now()
+	rawSQL, err := sqlutil.Interpolate(&q, d.driver.Macros())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", "Could not apply macros", err)
+	}
+	inner := subquery(rawSQL)
+	filter := ""
+	if after != "" {
+		filter = fmt.Sprintf(" WHERE %s > %s", quoteIdentifier(column), after)
+	}
+	q.RawSQL = fmt.Sprintf("SELECT * FROM (%s) AS stream%s ORDER BY %s", inner, filter, quoteIdentifier(column))
+	return d.runQuery(ctx, &q)
+}
@@ -0,0 +1,416 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+)
+
+type packetRecorder chan *backend.StreamPacket
+
+func (r packetRecorder) Send(packet *backend.StreamPacket) error {
+	r <- packet
+	return nil
+}
+
+func TestStreamAppendedRows(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		UID:      "duck",
+		JSONData: []byte(`{"path":"", "initSql": "CREATE TABLE events AS SELECT i AS seq, 'event ' || i AS message FROM range(0, 3) t(i);"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(model map[string]any) backend.DataResponse {
+		t.Helper()
+		encoded, _ := json.Marshal(model)
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: encoded}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Responses["A"]
+	}
+
+	resp := run(map[string]any{
+		"rawSql": "SELECT seq, message FROM events",
+		"format": sqlutil.FormatOptionTable,
+		"stream": map[string]any{"column": "seq", "interval": "100ms"},
+	})
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	frame := resp.Frames[0]
+	if frame.Rows() != 3 {
+		t.Fatalf("expected the 3 rows of the table, got %d", frame.Rows())
+	}
+	channel, err := live.ParseChannel(frame.Meta.Channel)
+	if err != nil || channel.Scope != live.ScopeDatasource || channel.Namespace != "duck" {
+		t.Fatalf("expected a datasource channel, got %q", frame.Meta.Channel)
+	}
+
+	sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: channel.Path})
+	if err != nil || sub.Status != backend.SubscribeStreamStatusOK {
+		t.Fatalf("expected the subscription to be accepted, got %v %v", sub, err)
+	}
+	sub, _ = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: "stream/unknown"})
+	if sub.Status != backend.SubscribeStreamStatusNotFound {
+		t.Errorf("expected an unknown stream to be rejected, got %v", sub.Status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	packets := make(packetRecorder, 10)
+	done := make(chan error)
+	go func() {
+		done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: channel.Path}, backend.NewStreamSender(packets))
+	}()
+
+	if resp := run(map[string]any{"rawSql": "INSERT INTO events VALUES (3, 'event 3'), (4, 'event 4')", "format": sqlutil.FormatOptionTable}); resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	select {
+	case packet := <-packets:
+		var sent data.Frame
+		if err := json.Unmarshal(packet.Data, &sent); err != nil {
+			t.Fatal(err)
+		}
+		if sent.Rows() != 2 || !strings.Contains(string(packet.Data), "event 3") || strings.Contains(string(packet.Data), "event 2") {
+			t.Errorf("expected only the 2 appended rows, got %s", packet.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the appended rows to be sent")
+	}
+
+	select {
+	case packet := <-packets:
+		t.Errorf("expected no rows to be sent twice, got %s", packet.Data)
+	case <-time.After(300 * time.Millisecond):
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected the stream to stop without an error, got %v", err)
+	}
+}
+
+func TestStreamExpiryAndAdmission(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		UID:      "duck",
+		JSONData: []byte(`{"path":"", "maxConcurrentQueries": 1}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.streams.ttl = 50 * time.Millisecond
+	start := func(sql string) string {
+		t.Helper()
+		encoded, _ := json.Marshal(map[string]any{
+			"rawSql": sql,
+			"format": sqlutil.FormatOptionTable,
+			"stream": map[string]any{"column": "seq", "interval": "100ms"},
+		})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: encoded}},
+		})
+		if err != nil || resp.Responses["A"].Error != nil {
+			t.Fatal(err, resp.Responses["A"].Error)
+		}
+		channel, _ := live.ParseChannel(resp.Responses["A"].Frames[0].Meta.Channel)
+		return channel.Path
+	}
+
+	unsubscribed := start("SELECT 1 AS seq")
+	subscribed := start("SELECT 2 AS seq")
+	if sub, _ := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: subscribed}); sub.Status != backend.SubscribeStreamStatusOK {
+		t.Fatalf("expected the subscription to be accepted, got %v", sub.Status)
+	}
+	time.Sleep(100 * time.Millisecond)
+	start("SELECT 3 AS seq")
+	if sub, _ := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: unsubscribed}); sub.Status != backend.SubscribeStreamStatusNotFound {
+		t.Errorf("expected the unsubscribed stream to expire, got %v", sub.Status)
+	}
+	if _, ok := ds.streams.streams[unsubscribed]; ok {
+		t.Errorf("expected the expired stream to be forgotten")
+	}
+	if sub, _ := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: subscribed}); sub.Status != backend.SubscribeStreamStatusOK {
+		t.Errorf("expected the subscribed stream to be kept, got %v", sub.Status)
+	}
+
+	// Polls wait for the query slot like other queries.
+	release, err := ds.admission.Acquire(context.Background(), classDashboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: subscribed}, backend.NewStreamSender(make(packetRecorder, 10)))
+	}()
+	waiting := func() int {
+		ds.admission.mu.Lock()
+		defer ds.admission.mu.Unlock()
+		return ds.admission.waiting()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for waiting() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := waiting(); n != 1 {
+		t.Errorf("expected the poll to wait for the query slot, %d waiting", n)
+	}
+	release()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected the stream to stop without an error, got %v", err)
+	}
+}
+
+func TestStreamDirectoryFiles(t *testing.T) {
+	landing := t.TempDir()
+	cursors := t.TempDir()
+	writeFile := func(name string, rows string) {
+		t.Helper()
+		// Files are moved into the directory once they are complete.
+		tmp := filepath.Join(cursors, name)
+		if err := os.WriteFile(tmp, []byte("id,name\n"+rows), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(landing, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("a.csv", "1,old\n")
+
+	settings, _ := json.Marshal(map[string]any{"path": "", "streamCursorDirectory": cursors})
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{UID: "duck", JSONData: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// start subscribes to the stream of the query and returns the rows sent to it.
+	start := func() (<-chan string, func()) {
+		t.Helper()
+		encoded, _ := json.Marshal(map[string]any{
+			"rawSql": "SELECT name FROM read_csv($__file)",
+			"format": sqlutil.FormatOptionTable,
+			"stream": map[string]any{"files": filepath.Join(landing, "*.csv"), "interval": "100ms"},
+		})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: encoded}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Responses["A"].Error != nil {
+			t.Fatal(resp.Responses["A"].Error)
+		}
+		channel, err := live.ParseChannel(resp.Responses["A"].Frames[0].Meta.Channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		packets := make(packetRecorder, 10)
+		names := make(chan string, 10)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := ds.RunStream(ctx, &backend.RunStreamRequest{Path: channel.Path}, backend.NewStreamSender(packets)); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			for packet := range packets {
+				var frame data.Frame
+				if err := json.Unmarshal(packet.Data, &frame); err != nil {
+					t.Error(err)
+					continue
+				}
+				for i := 0; i < frame.Rows(); i++ {
+					names <- stringValue(frame.Fields[0], i)
+				}
+			}
+		}()
+		// Let the stream record the files that are already there.
+		time.Sleep(300 * time.Millisecond)
+		return names, func() { cancel(); <-done }
+	}
+	expect := func(names <-chan string, want string) {
+		t.Helper()
+		select {
+		case name := <-names:
+			if name != want {
+				t.Errorf("expected the rows of the new file, got %q", name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the rows of the file with %q", want)
+		}
+		select {
+		case name := <-names:
+			t.Errorf("expected no other rows, got %q", name)
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+
+	names, stop := start()
+	writeFile("b.csv", "2,new\n")
+	expect(names, "new")
+	stop()
+
+	// Files arriving while no one is subscribed are read on the next run, the others are not
+	// read again.
+	writeFile("c.csv", "3,while stopped\n")
+	names, stop = start()
+	expect(names, "while stopped")
+
+	// A file still being written is read once its size no longer changes.
+	partial := filepath.Join(landing, "d.csv")
+	if err := os.WriteFile(partial, []byte("id,name\n4,par"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := os.WriteFile(partial, []byte("id,name\n4,partial then complete\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expect(names, "partial then complete")
+
+	// A file that cannot be read is retried, and read once it is fixed.
+	broken := filepath.Join(landing, "e.csv")
+	if err := os.WriteFile(broken, []byte("id,label\n5,missing the name column\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(350 * time.Millisecond)
+	if err := os.WriteFile(broken, []byte("id,name\n5,fixed after a failed read\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expect(names, "fixed after a failed read")
+	stop()
+}
+
+func TestStreamDirectoryFilesPolicy(t *testing.T) {
+	landing := t.TempDir()
+	settings, _ := json.Marshal(map[string]any{
+		"path":                  "",
+		"streamCursorDirectory": t.TempDir(),
+		"deniedTableFunctions":  []string{"glob"},
+		"policyExemptRoles":     []string{"Admin"},
+	})
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{UID: "duck", JSONData: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, _ := json.Marshal(map[string]any{
+		"rawSql": "SELECT name FROM read_csv($__file)",
+		"format": sqlutil.FormatOptionTable,
+		"stream": map[string]any{"files": filepath.Join(landing, "*.csv")},
+	})
+	for role, allowed := range map[string]bool{"Viewer": false, "Admin": true} {
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{User: &backend.User{Login: "user", Role: role}},
+			Queries:       []backend.DataQuery{{RefID: "A", JSON: encoded}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := resp.Responses["A"]
+		if allowed && res.Error != nil {
+			t.Errorf("%s: %v", role, res.Error)
+		}
+		if !allowed && (!errors.Is(res.Error, ErrorPolicy) || !strings.Contains(res.Error.Error(), "table function glob")) {
+			t.Errorf("%s: expected listing the files to be rejected, got: %v", role, res.Error)
+		}
+	}
+}
+
+func TestStreamSubscriberPolicy(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		UID: "duck",
+		JSONData: []byte(`{"path":"", "initSql": "CREATE TABLE events AS SELECT i AS seq FROM range(0, 3) t(i);",
+			"deniedFunctions": ["upper"], "policyExemptRoles": ["Admin"]}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, _ := json.Marshal(map[string]any{
+		"rawSql": "SELECT seq, upper('a') AS a FROM events",
+		"format": sqlutil.FormatOptionTable,
+		"stream": map[string]any{"column": "seq"},
+	})
+	admin := &backend.User{Login: "admin", Role: "Admin"}
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{User: admin},
+		Queries:       []backend.DataQuery{{RefID: "A", JSON: encoded}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Responses["A"].Error != nil {
+		t.Fatal(resp.Responses["A"].Error)
+	}
+	channel, err := live.ParseChannel(resp.Responses["A"].Frames[0].Meta.Channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viewer := &backend.User{Login: "viewer", Role: "Viewer"}
+	sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{
+		PluginContext: backend.PluginContext{User: viewer},
+		Path:          channel.Path,
+	})
+	if err != nil || sub.Status != backend.SubscribeStreamStatusPermissionDenied {
+		t.Errorf("expected a user the policy applies to be denied the channel of an exempt user, got %v %v", sub, err)
+	}
+	sub, err = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{
+		PluginContext: backend.PluginContext{User: admin},
+		Path:          channel.Path,
+	})
+	if err != nil || sub.Status != backend.SubscribeStreamStatusOK {
+		t.Errorf("expected the exempt user to subscribe, got %v %v", sub, err)
+	}
+}
+
+func TestStreamStaleCursors(t *testing.T) {
+	cursors := t.TempDir()
+	old := time.Now().Add(-streamCursorRetention - time.Hour)
+	for name, modTime := range map[string]time.Time{
+		"duck-stale.json":  old,
+		"duck-recent.json": time.Now(),
+		"other-stale.json": old,
+	} {
+		path := filepath.Join(cursors, name)
+		if err := os.WriteFile(path, []byte(`{"files":{}}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings, _ := json.Marshal(map[string]any{"path": "", "streamCursorDirectory": cursors})
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	if _, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{UID: "duck", JSONData: settings}); err != nil {
+		t.Fatal(err)
+	}
+	for name, kept := range map[string]bool{"duck-stale.json": false, "duck-recent.json": true, "other-stale.json": true} {
+		if _, err := os.Stat(filepath.Join(cursors, name)); (err == nil) != kept {
+			t.Errorf("expected %s to be kept: %v, got %v", name, kept, err)
+		}
+	}
+}
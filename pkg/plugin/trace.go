@@ -0,0 +1,234 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// traceColumn describes a field of the trace frame Grafana's trace view reads, and the names of
+// the columns it is read from. Column names are compared case-insensitively and without
+// underscores, so trace_id, traceId and TraceID all name the trace id.
+type traceColumn struct {
+	field    string
+	names    []string
+	required bool
+}
+
+var traceColumns = []traceColumn{
+	{field: "traceID", names: []string{"traceid"}, required: true},
+	{field: "spanID", names: []string{"spanid"}, required: true},
+	{field: "parentSpanID", names: []string{"parentspanid", "parentid"}},
+	{field: "operationName", names: []string{"operationname", "spanname", "name"}, required: true},
+	{field: "serviceName", names: []string{"servicename", "service"}, required: true},
+	{field: "startTime", names: []string{"starttime", "start", "timestamp"}, required: true},
+	{field: "duration", names: []string{"duration", "durationms"}, required: true},
+	{field: "tags", names: []string{"tags", "attributes", "spanattributes"}},
+	{field: "serviceTags", names: []string{"servicetags", "resourceattributes", "resource"}},
+	{field: "kind", names: []string{"kind", "spankind"}},
+	{field: "statusCode", names: []string{"statuscode"}},
+	{field: "statusMessage", names: []string{"statusmessage"}},
+}
+
+// traceStatusCodes maps the names of OpenTelemetry span status codes to their numbers.
+var traceStatusCodes = map[string]int64{
+	"unset": 0, "status_code_unset": 0,
+	"ok": 1, "status_code_ok": 1,
+	"error": 2, "status_code_error": 2,
+}
+
+type traceTag struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+// formatTrace converts a table of spans into the trace frame of Grafana's trace view. Start times
+// are read from time columns or as epoch milliseconds, durations as milliseconds, and tags from
+// STRUCT, MAP or JSON columns.
+func formatTrace(frame *data.Frame) (*data.Frame, error) {
+	columns := map[string]*data.Field{}
+	var missing []string
+	for _, column := range traceColumns {
+		field := findTraceField(frame, column.names)
+		if field == nil {
+			if column.required {
+				missing = append(missing, column.field)
+			}
+			continue
+		}
+		columns[column.field] = field
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("the trace format requires the columns %s", strings.Join(missing, ", "))
+	}
+	if field := columns["startTime"]; !field.Type().Time() && !field.Type().Numeric() {
+		return nil, fmt.Errorf("the startTime column of the trace format must be a time or epoch milliseconds, got %s", field.Type().ItemTypeString())
+	}
+	if field := columns["duration"]; !field.Type().Numeric() {
+		return nil, fmt.Errorf("the duration column of the trace format must be a number of milliseconds, got %s", field.Type().ItemTypeString())
+	}
+
+	var (
+		traceIDs, spanIDs, parentSpanIDs []string
+		operationNames, serviceNames     []string
+		startTimes, durations            []float64
+		tags, serviceTags                []json.RawMessage
+		kinds, statusMessages            []string
+		statusCodes                      []int64
+	)
+	for i := 0; i < frame.Rows(); i++ {
+		for _, name := range []string{"traceID", "spanID", "startTime", "duration"} {
+			if _, ok := columns[name].ConcreteAt(i); !ok {
+				return nil, fmt.Errorf("the %s column of span %d is null", name, i+1)
+			}
+		}
+		traceIDs = append(traceIDs, stringValue(columns["traceID"], i))
+		spanIDs = append(spanIDs, stringValue(columns["spanID"], i))
+		parentSpanIDs = append(parentSpanIDs, optionalStringValue(columns["parentSpanID"], i))
+		operationNames = append(operationNames, stringValue(columns["operationName"], i))
+		serviceNames = append(serviceNames, stringValue(columns["serviceName"], i))
+
+		start, _ := columns["startTime"].ConcreteAt(i)
+		if ts, ok := start.(time.Time); ok {
+			startTimes = append(startTimes, float64(ts.UnixMilli())+float64(ts.Nanosecond()%int(time.Millisecond))/float64(time.Millisecond))
+		} else {
+			ms, _ := columns["startTime"].FloatAt(i)
+			startTimes = append(startTimes, ms)
+		}
+		duration, _ := columns["duration"].FloatAt(i)
+		durations = append(durations, duration)
+
+		for _, t := range []struct {
+			name string
+			out  *[]json.RawMessage
+		}{{"tags", &tags}, {"serviceTags", &serviceTags}} {
+			encoded, err := traceTags(columns[t.name], i)
+			if err != nil {
+				return nil, fmt.Errorf("the %s column of span %d: %w", t.name, i+1, err)
+			}
+			*t.out = append(*t.out, encoded)
+		}
+
+		kind := strings.ToLower(optionalStringValue(columns["kind"], i))
+		kinds = append(kinds, strings.TrimPrefix(kind, "span_kind_"))
+		statusCodes = append(statusCodes, traceStatusCode(columns["statusCode"], i))
+		statusMessages = append(statusMessages, optionalStringValue(columns["statusMessage"], i))
+	}
+
+	trace := data.NewFrame(frame.Name,
+		data.NewField("traceID", nil, traceIDs),
+		data.NewField("spanID", nil, spanIDs),
+		data.NewField("parentSpanID", nil, parentSpanIDs),
+		data.NewField("operationName", nil, operationNames),
+		data.NewField("serviceName", nil, serviceNames),
+		data.NewField("serviceTags", nil, serviceTags),
+		data.NewField("startTime", nil, startTimes),
+		data.NewField("duration", nil, durations),
+		data.NewField("tags", nil, tags),
+		data.NewField("kind", nil, kinds),
+		data.NewField("statusCode", nil, statusCodes),
+		data.NewField("statusMessage", nil, statusMessages),
+	)
+	trace.RefID = frame.RefID
+
+	meta := data.FrameMeta{}
+	if frame.Meta != nil {
+		meta = *frame.Meta
+	}
+	meta.PreferredVisualization = data.VisTypeTrace
+	trace.Meta = &meta
+	return trace, nil
+}
+
+func findTraceField(frame *data.Frame, names []string) *data.Field {
+	for _, name := range names {
+		for _, field := range frame.Fields {
+			if strings.ReplaceAll(strings.ToLower(field.Name), "_", "") == name {
+				return field
+			}
+		}
+	}
+	return nil
+}
+
+// optionalStringValue is stringValue for columns the query may leave out.
+func optionalStringValue(field *data.Field, i int) string {
+	if field == nil {
+		return ""
+	}
+	return stringValue(field, i)
+}
+
+// traceTags encodes the tags of a span as the list of key and value pairs the trace view reads.
+// Objects are sorted by key; lists of key and value pairs are passed through.
+func traceTags(field *data.Field, i int) (json.RawMessage, error) {
+	if field == nil {
+		return json.RawMessage("[]"), nil
+	}
+	v, ok := field.ConcreteAt(i)
+	if !ok {
+		return json.RawMessage("[]"), nil
+	}
+	var encoded []byte
+	switch v := v.(type) {
+	case json.RawMessage:
+		encoded = v
+	case string:
+		encoded = []byte(v)
+	default:
+		return nil, fmt.Errorf("expected a STRUCT, MAP or JSON value, got %s", field.Type().ItemTypeString())
+	}
+
+	var pairs []traceTag
+	if err := json.Unmarshal(encoded, &pairs); err == nil && pairs != nil && keyed(pairs) {
+		return encoded, nil
+	}
+	var object map[string]any
+	if err := json.Unmarshal(encoded, &object); err != nil {
+		return nil, fmt.Errorf("expected an object or a list of key and value pairs")
+	}
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs = make([]traceTag, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, traceTag{Key: key, Value: object[key]})
+	}
+	return json.Marshal(pairs)
+}
+
+func keyed(pairs []traceTag) bool {
+	for _, pair := range pairs {
+		if pair.Key == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// traceStatusCode reads an OpenTelemetry status code given by number or by name.
+func traceStatusCode(field *data.Field, i int) int64 {
+	if field == nil {
+		return 0
+	}
+	if _, ok := field.ConcreteAt(i); !ok {
+		return 0
+	}
+	if field.Type().Numeric() {
+		code, _ := field.FloatAt(i)
+		return int64(code)
+	}
+	value := strings.ToLower(stringValue(field, i))
+	if code, ok := traceStatusCodes[value]; ok {
+		return code
+	}
+	code, _ := strconv.ParseInt(value, 10, 64)
+	return code
+}
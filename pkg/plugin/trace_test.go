@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+func TestTraceFormat(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "initSql": "CREATE TABLE spans AS SELECT 'abc' AS trace_id, 's' || i AS span_id, CASE WHEN i > 0 THEN 's0' END AS parent_span_id, 'GET /' || i AS span_name, 'api' AS service_name, TIMESTAMP '2024-01-01' + to_milliseconds(i * 10) AS start_time, 5.5 AS duration_ms, {'http.status_code': 200 + i, 'http.method': 'GET'} AS attributes, MAP {'host.name': 'web-1'} AS resource_attributes, 'SPAN_KIND_SERVER' AS span_kind, ['STATUS_CODE_OK', 'STATUS_CODE_ERROR'][i % 2 + 1] AS status_code FROM range(0, 3) t(i);"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(sql string) backend.DataResponse {
+		t.Helper()
+		encoded, _ := json.Marshal(map[string]any{"rawSql": sql, "format": sqlutil.FormatOptionTrace})
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: encoded}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Responses["A"]
+	}
+
+	resp := query("SELECT * FROM spans ORDER BY span_id")
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	frame := resp.Frames[0]
+	if frame.Meta.PreferredVisualization != data.VisTypeTrace {
+		t.Errorf("expected the trace visualization, got %q", frame.Meta.PreferredVisualization)
+	}
+	if frame.Rows() != 3 {
+		t.Fatalf("expected 3 spans, got %d", frame.Rows())
+	}
+	field := func(name string) *data.Field {
+		f, _ := frame.FieldByName(name)
+		if f == nil {
+			t.Fatalf("expected a %s field", name)
+		}
+		return f
+	}
+	if got := field("parentSpanID").At(0); got != "" {
+		t.Errorf("expected the root span to have no parent, got %q", got)
+	}
+	if got := field("parentSpanID").At(1); got != "s0" {
+		t.Errorf("expected span s1 to have parent s0, got %q", got)
+	}
+	if got := field("operationName").At(2); got != "GET /2" {
+		t.Errorf("expected the span name as operation name, got %q", got)
+	}
+	if got := field("startTime").At(1); got != float64(1704067200010) {
+		t.Errorf("expected the start time in epoch milliseconds, got %v", got)
+	}
+	if got := field("duration").At(0); got != 5.5 {
+		t.Errorf("expected a duration of 5.5ms, got %v", got)
+	}
+	if got := string(field("tags").At(1).(json.RawMessage)); got != `[{"key":"http.method","value":"GET"},{"key":"http.status_code","value":201}]` {
+		t.Errorf("unexpected tags %s", got)
+	}
+	if got := string(field("serviceTags").At(0).(json.RawMessage)); got != `[{"key":"host.name","value":"web-1"}]` {
+		t.Errorf("unexpected service tags %s", got)
+	}
+	if got := field("kind").At(0); got != "server" {
+		t.Errorf("expected kind server, got %q", got)
+	}
+	if got := field("statusCode").At(1); got != int64(2) {
+		t.Errorf("expected status code 2, got %v", got)
+	}
+
+	resp = query("SELECT trace_id, span_id, start_time FROM spans")
+	if resp.Error == nil || !strings.Contains(resp.Error.Error(), "operationName, serviceName, duration") {
+		t.Errorf("expected an error naming the missing columns, got %v", resp.Error)
+	}
+	resp = query("SELECT trace_id, span_id, span_name, service_name, start_time, 'slow' AS duration FROM spans")
+	if resp.Error == nil || !strings.Contains(resp.Error.Error(), "duration") {
+		t.Errorf("expected a text duration to be rejected, got %v", resp.Error)
+	}
+}
+
+func TestNestedConverter(t *testing.T) {
+	for format, nested := range map[sqlutil.FormatQueryOption]bool{
+		sqlutil.FormatOptionTable:      false,
+		sqlutil.FormatOptionTimeSeries: false,
+		sqlutil.FormatOptionLogs:       false,
+		sqlutil.FormatOptionTrace:      true,
+	} {
+		got := false
+		for _, converter := range converters(format, GetConverterList()) {
+			got = got || converter.Name == nestedConverter.Name
+		}
+		if got != nested {
+			t.Errorf("format %d: expected nested values to be encoded as JSON: %v, got %v", format, nested, got)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package plugin
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/sqlds/v3"
+)
+
+// macroPattern matches the names of macros, their arguments are found by balancing parentheses
+// the way sqlutil does.
+var macroPattern = regexp.MustCompile(`\$__(\w+)`)
+
+// errorContext matches the excerpt DuckDB appends to binder and catalog errors: the line of the
+// statement with the error and a caret under the error.
+var errorContext = regexp.MustCompile(`\n\s*LINE (\d+): ([^\n]*)\n( *)\^\s*$`)
+
+// validationRequest is the body of the /validate resource: a panel query with the time range its
+// macros are expanded for, as epoch milliseconds. To defaults to now and From to an hour before To.
+type validationRequest struct {
+	From int64 `json:"from,omitempty"`
+	To   int64 `json:"to,omitempty"`
+}
+
+// validationError is an error in a query. Line and Column, both from 1, locate it in the query
+// text with its macros unexpanded. They are 0 when DuckDB does not report a position.
+type validationError struct {
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+}
+
+// handleValidate checks a query without running it: its macros are expanded, then DuckDB parses
+// and binds its statements, which resolves tables, columns and functions. Statements after the
+// first one that is not a SELECT are only parsed, their tables may not exist until it runs.
+func (d *SQLDataSourceWrapper) handleValidate(rw http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		sendResourceError(rw, http.StatusBadRequest, err)
+		return
+	}
+	var options validationRequest
+	if err := json.Unmarshal(body, &options); err != nil {
+		sendResourceError(rw, http.StatusBadRequest, fmt.Errorf("%w: %v", sqlds.ErrorWrongOptions, err))
+		return
+	}
+	// Each bound defaults on its own, a time range of the last hour ending at To or now.
+	timeRange := backend.TimeRange{To: time.Now()}
+	if options.To != 0 {
+		timeRange.To = time.UnixMilli(options.To)
+	}
+	timeRange.From = timeRange.To.Add(-time.Hour)
+	if options.From != 0 {
+		timeRange.From = time.UnixMilli(options.From)
+	}
+	q, err := sqlds.GetQuery(backend.DataQuery{RefID: "validate", JSON: body, TimeRange: timeRange, Interval: time.Minute}, nil, false)
+	if err != nil {
+		sendResourceError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), d.DriverSettings().Timeout)
+	defer cancel()
+	rawSQL, errs, err := d.validateQuery(ctx, q)
+	if err != nil {
+		sendResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	sendResource(rw, map[string]any{
+		"valid":  len(errs) == 0,
+		"rawSql": rawSQL,
+		"errors": errs,
+	})
+}
+
+// validateQuery returns the macro-expanded query and its errors. err is only set when the query
+// could not be checked.
+func (d *SQLDataSourceWrapper) validateQuery(ctx context.Context, q *sqlutil.Query) (string, []validationError, error) {
+	original := q.RawSQL
+	rawSQL, offsets, err := expandMacros(q, d.driver.Macros())
+	if err != nil {
+		var macroErr *macroError
+		if errors.As(err, &macroErr) {
+			return original, []validationError{newValidationError(original, macroErr.offset, macroErr.Error())}, nil
+		}
+		return original, nil, err
+	}
+	errs := []validationError{}
+
+	if d.readOnly {
+		if err := checkReadOnly(ctx, rawSQL); errors.Is(err, ErrorReadOnly) {
+			errs = append(errs, validationError{Message: err.Error()})
+		}
+	}
+	// Binding reads the files queries refer to, it is skipped for queries the policy rejects.
+	bind := len(errs) == 0
+	if d.policy != nil {
+		if err := d.policy.Check(ctx, rawSQL); errors.Is(err, ErrorPolicy) {
+			errs = append(errs, validationError{Message: err.Error()})
+			bind = false
+		}
+	}
+
+	statements, err := extractStatements(ctx, rawSQL)
+	if ctx.Err() != nil {
+		// The checks above ignore their own errors, a validation cut short must not be reported
+		// as a query error.
+		if err == nil {
+			err = ctx.Err()
+		}
+		return rawSQL, nil, queryError(ctx, d.DriverSettings().Timeout, err)
+	}
+	if err != nil {
+		// The statements of a query with a syntax error cannot be extracted, the error is located
+		// by parsing the whole query.
+		serialized, serr := serializeStatements(ctx, rawSQL)
+		if serr != nil {
+			return rawSQL, nil, serr
+		}
+		e := validationError{Message: err.Error()}
+		if serialized.Error && !serialized.notSelect() {
+			e.Message = serialized.ErrorMessage
+			if position, err := strconv.Atoi(serialized.ErrorPosition); err == nil {
+				e = newValidationError(original, offsets.original(position), serialized.ErrorMessage)
+			}
+		}
+		return rawSQL, append(errs, e), nil
+	}
+
+	if !bind {
+		return rawSQL, errs, nil
+	}
+	// Binding reads the schemas of the files and remote tables the statements refer to, it waits
+	// for a query slot like panel queries.
+	conn, release, err := d.resourceConn(ctx, q, d.DriverSettings().Timeout)
+	if err != nil {
+		return rawSQL, nil, err
+	}
+	// Statements are only prepared, but the connection is discarded like the connections of
+	// multi-statement queries, so that nothing a statement does to it reaches the pool.
+	defer func() {
+		_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		release()
+	}()
+
+	for _, statement := range statements {
+		if !bind {
+			break
+		}
+		serialized, err := serializeStatements(ctx, statement.Text)
+		if err != nil {
+			return rawSQL, nil, err
+		}
+		// Statements after the first one that is not a SELECT may refer to the tables it creates.
+		bind = !serialized.notSelect()
+
+		stmt, err := conn.PrepareContext(ctx, statement.Text)
+		if err == nil {
+			_ = stmt.Close()
+			continue
+		}
+		if ctx.Err() != nil {
+			return rawSQL, nil, queryError(ctx, d.DriverSettings().Timeout, err)
+		}
+		message, position := bindErrorPosition(statement.Text, err.Error())
+		if position < 0 {
+			errs = append(errs, validationError{Message: message})
+		} else {
+			errs = append(errs, newValidationError(original, offsets.original(statement.Offset+position), message))
+		}
+		bind = false
+	}
+	return rawSQL, errs, nil
+}
+
+// newValidationError returns the error message located at the byte offset of text.
+func newValidationError(text string, offset int, message string) validationError {
+	offset = min(max(offset, 0), len(text))
+	lineStart := strings.LastIndexByte(text[:offset], '\n') + 1
+	return validationError{
+		Message: message,
+		Line:    strings.Count(text[:offset], "\n") + 1,
+		Column:  utf8.RuneCountInString(text[lineStart:offset]) + 1,
+	}
+}
+
+// bindErrorPosition splits the excerpt DuckDB appends to errors from message, and returns the
+// byte offset in statement it points at, or -1. Long lines are excerpted around the error with
+// "..." on the cut sides, the excerpt is searched in the line to find the offset.
+func bindErrorPosition(statement string, message string) (string, int) {
+	m := errorContext.FindStringSubmatchIndex(message)
+	if m == nil {
+		return message, -1
+	}
+	line, _ := strconv.Atoi(message[m[2]:m[3]])
+	excerpt := message[m[4]:m[5]]
+	caret := m[7] - m[6] - len(fmt.Sprintf("LINE %d: ", line))
+	message = strings.TrimSpace(message[:m[0]])
+
+	lines := strings.SplitAfter(statement, "\n")
+	if line < 1 || line > len(lines) {
+		return message, -1
+	}
+	lineStart := 0
+	for _, l := range lines[:line-1] {
+		lineStart += len(l)
+	}
+	text := strings.TrimRight(lines[line-1], "\r\n")
+
+	shown := strings.TrimSuffix(excerpt, "...")
+	if strings.HasPrefix(shown, "...") {
+		shown = shown[3:]
+		caret -= 3
+	}
+	start := strings.Index(text, shown)
+	if start < 0 {
+		start = 0
+	}
+	return message, lineStart + min(max(start+caret, 0), len(text))
+}
+
+// macroError is a macro that could not be expanded, at the byte offset of the query text.
+type macroError struct {
+	offset int
+	err    error
+}
+
+func (e *macroError) Error() string { return e.err.Error() }
+
+func (e *macroError) Unwrap() error { return e.err }
+
+// sourceMap maps byte offsets of a macro-expanded query back to its text with the macros
+// unexpanded. Offsets within the expansion of a macro map to the start of the macro.
+type sourceMap struct {
+	segments []sourceSegment
+}
+
+type sourceSegment struct {
+	expanded int
+	original int
+	macro    bool
+}
+
+func (m *sourceMap) original(offset int) int {
+	i := sort.Search(len(m.segments), func(i int) bool { return m.segments[i].expanded > offset }) - 1
+	if i < 0 {
+		return offset
+	}
+	segment := m.segments[i]
+	if segment.macro {
+		return segment.original
+	}
+	return segment.original + offset - segment.expanded
+}
+
+// expandMacros expands the macros of q like sqlutil.Interpolate, one macro at a time, and records
+// where each part of the expanded query comes from.
+func expandMacros(q *sqlutil.Query, macros sqlutil.Macros) (string, *sourceMap, error) {
+	known := sqlutil.Macros{}
+	maps.Copy(known, sqlutil.DefaultMacros)
+	maps.Copy(known, macros)
+
+	text := q.RawSQL
+	var expanded strings.Builder
+	offsets := &sourceMap{}
+	literal := func(start, end int) {
+		if start < end {
+			offsets.segments = append(offsets.segments, sourceSegment{expanded: expanded.Len(), original: start})
+			expanded.WriteString(text[start:end])
+		}
+	}
+
+	pos := 0
+	for pos < len(text) {
+		m := macroPattern.FindStringSubmatchIndex(text[pos:])
+		if m == nil {
+			break
+		}
+		start, end := pos+m[0], pos+m[1]
+		if _, ok := known[text[pos+m[2]:pos+m[3]]]; !ok {
+			literal(pos, end)
+			pos = end
+			continue
+		}
+		if strings.HasPrefix(text[end:], "(") {
+			length := macroArgsLength(text[end:])
+			if length < 0 {
+				return "", nil, &macroError{start, errors.New("failed to parse macro arguments (missing close bracket?)")}
+			}
+			end += length
+		}
+
+		literal(pos, start)
+		macro := *q
+		macro.RawSQL = text[start:end]
+		result, err := sqlutil.Interpolate(&macro, macros)
+		if err != nil {
+			return "", nil, &macroError{start, err}
+		}
+		offsets.segments = append(offsets.segments, sourceSegment{expanded: expanded.Len(), original: start, macro: true})
+		expanded.WriteString(result)
+		pos = end
+	}
+	literal(pos, len(text))
+	return expanded.String(), offsets, nil
+}
+
+// macroArgsLength returns the length of the parenthesized arguments args starts with, or -1 when
+// the parentheses are not closed.
+func macroArgsLength(args string) int {
+	depth := 0
+	for i, r := range args {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
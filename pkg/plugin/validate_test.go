@@ -0,0 +1,136 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+func TestValidate(t *testing.T) {
+	newDatasource := func(settings string) *SQLDataSourceWrapper {
+		t.Helper()
+		ds := NewDatasource(&DuckDBDriver{Initialized: false})
+		_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{"path":"", "initSql": "CREATE TABLE metrics (ts TIMESTAMP, host VARCHAR, value DOUBLE);"` + settings + `}`),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ds
+	}
+	ds := newDatasource("")
+
+	long := "SELECT " + strings.Repeat("value + 1, ", 40)
+	// The messages of the expected errors are prefixes, DuckDB adds suggestions to them.
+	tests := []struct {
+		name     string
+		ds       *SQLDataSourceWrapper
+		rawSQL   string
+		expected []validationError
+	}{
+		{"valid", nil, "SELECT ts, value FROM metrics WHERE $__timeFilter(ts)", []validationError{}},
+		{"syntax error after a macro", nil, "SELECT ts FROM metrics\nWHERE $__timeFilter(ts) AN value > 1",
+			[]validationError{{Message: `syntax error at or near "AN"`, Line: 2, Column: 25}}},
+		{"unknown column after a macro", nil, "SELECT $__timeFrom AS start,\n  nope FROM metrics",
+			[]validationError{{Message: "Binder Error: Referenced column \"nope\" not found in FROM clause!", Line: 2, Column: 3}}},
+		{"error in a macro", nil, "SELECT value FROM metrics\nWHERE host = 'a' AND $__timeFilter(nope)",
+			[]validationError{{Message: "Binder Error: Referenced column \"nope\" not found in FROM clause!", Line: 2, Column: 22}}},
+		{"syntax error after a quoted semicolon", nil, "SELECT 'a;b' AS s, $$c;d$$ AS t;\nSELECT * FROM metrics WHERE",
+			[]validationError{{Message: "syntax error at end of input", Line: 2, Column: 28}}},
+		{"unknown table", nil, "SELECT 1;\n\nSELECT * FROM missing",
+			[]validationError{{Message: "Catalog Error: Table with name missing does not exist!", Line: 3, Column: 15}}},
+		{"excerpt of a long line", nil, long + "nope, " + strings.Repeat("value + 2, ", 40) + "1 FROM metrics",
+			[]validationError{{Message: "Binder Error: Referenced column \"nope\" not found in FROM clause!", Line: 1, Column: len(long) + 1}}},
+		{"statements after a non-SELECT", nil, "CREATE TEMP TABLE recent AS SELECT * FROM metrics; SELECT host FROM recent", []validationError{}},
+		{"unclosed macro", nil, "SELECT * FROM metrics WHERE $__timeFilter(ts",
+			[]validationError{{Message: "failed to parse macro arguments (missing close bracket?)", Line: 1, Column: 29}}},
+		{"policy", newDatasource(`, "deniedFunctions": ["lower"]`), "SELECT lower(host) FROM metrics",
+			[]validationError{{Message: "the query is not allowed by the datasource policy: function lower is not allowed"}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			target := ds
+			if tc.ds != nil {
+				target = tc.ds
+			}
+			body, _ := json.Marshal(map[string]any{"rawSql": tc.rawSQL, "from": 1704067200000, "to": 1704070800000})
+			resp := callResource(t, target, "validate", body)
+			if resp.Status != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Status, resp.Body)
+			}
+			var result struct {
+				Valid  bool              `json:"valid"`
+				RawSQL string            `json:"rawSql"`
+				Errors []validationError `json:"errors"`
+			}
+			if err := json.Unmarshal(resp.Body, &result); err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Errors) != len(tc.expected) {
+				t.Fatalf("expected %+v, got %+v", tc.expected, result.Errors)
+			}
+			for i, e := range result.Errors {
+				if !strings.HasPrefix(e.Message, tc.expected[i].Message) || e.Line != tc.expected[i].Line || e.Column != tc.expected[i].Column {
+					t.Errorf("expected %+v, got %+v", tc.expected[i], e)
+				}
+			}
+			if result.Valid != (len(tc.expected) == 0) {
+				t.Errorf("expected valid to be %v", len(tc.expected) == 0)
+			}
+			if strings.Contains(tc.rawSQL, "$__timeFilter(ts)") && !strings.Contains(result.RawSQL, "2024-01-01T00:00:00Z") {
+				t.Errorf("expected the macros to be expanded, got %s", result.RawSQL)
+			}
+		})
+	}
+}
+
+func TestValidateCanceled(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	if _, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: []byte(`{"path":""}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q := &sqlutil.Query{RawSQL: "SELECT '" + strings.Repeat(";", 3000) + "' AS s; SELECT 2"}
+	if _, errs, err := ds.validateQuery(ctx, q); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled validation to stop, got %v %+v", err, errs)
+	}
+}
+
+func TestValidateTimeRangeAndAdmission(t *testing.T) {
+	ds := NewDatasource(&DuckDBDriver{Initialized: false})
+	_, err := ds.NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"path":"", "initSql": "CREATE TABLE metrics (ts TIMESTAMP, value DOUBLE);", "maxConcurrentQueries": 1}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the end of the time range is set, its start is an hour before it.
+	body, _ := json.Marshal(map[string]any{"rawSql": "SELECT value FROM metrics WHERE $__timeFilter(ts)", "to": 1704070800000})
+	expectSlotWait(t, ds, func() {
+		resp := callResource(t, ds, "validate", body)
+		if resp.Status != http.StatusOK {
+			t.Errorf("expected status 200, got %d: %s", resp.Status, resp.Body)
+			return
+		}
+		var result struct {
+			Valid  bool   `json:"valid"`
+			RawSQL string `json:"rawSql"`
+		}
+		if err := json.Unmarshal(resp.Body, &result); err != nil {
+			t.Error(err)
+			return
+		}
+		if !result.Valid || !strings.Contains(result.RawSQL, "2024-01-01T00:00:00Z") || !strings.Contains(result.RawSQL, "2024-01-01T01:00:00Z") {
+			t.Errorf("expected the last hour before to, got %+v", result)
+		}
+	})
+}
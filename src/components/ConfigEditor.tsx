@@ -1,5 +1,5 @@
 import React, { ChangeEvent } from 'react';
-import { InlineField, Input, SecretInput, TextArea } from '@grafana/ui';
+import { Alert, InlineField, Input, SecretInput, TextArea } from '@grafana/ui';
 import { DataSourcePluginOptionsEditorProps } from '@grafana/data';
 import { DuckDBDataSourceOptions, SecureJsonData } from '../types';
 
@@ -40,6 +40,17 @@ export function ConfigEditor(props: Props) {
     });
   };
 
+  const onQueryTimeoutChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const value = parseInt(event.target.value, 10);
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...jsonData,
+        queryTimeout: isNaN(value) ? 0 : value,
+      },
+    });
+  };
+
   // Secure field (only sent to the backend)
   const onMotherDuckTokenChange = (event: ChangeEvent<HTMLInputElement>) => {
     onOptionsChange({
@@ -62,8 +73,17 @@ export function ConfigEditor(props: Props) {
     });
   };
 
+  // The sandbox is only set through provisioning, it blocks MotherDuck once the database is opened.
+  const sandboxBlocksMotherDuck = jsonData.sandbox && (jsonData.path ?? '').trim().startsWith('md:');
+
   return (
     <>
+      {sandboxBlocksMotherDuck && (
+        <Alert title="The sandbox blocks MotherDuck" severity="error">
+          This datasource enables the sandbox, which disables external access. MotherDuck databases cannot be queried
+          with the sandbox enabled, remove the sandbox option from the provisioned settings to connect.
+        </Alert>
+      )}
       <InlineField label="Database name" labelWidth={20} interactive tooltip={'path to DuckDB file or MotherDuck database string or leave blank to use in-memory database'}>
         <Input
           id="config-editor-path"
@@ -94,6 +114,16 @@ export function ConfigEditor(props: Props) {
           width={40}
         />
       </InlineField>
+      <InlineField label="Query Timeout" labelWidth={20} interactive tooltip={'Seconds after which a running query is interrupted (default: 30).'}>
+        <Input
+          id="config-editor-query-timeout"
+          type="number"
+          onChange={onQueryTimeoutChange}
+          value={jsonData.queryTimeout ?? ''}
+          placeholder="30"
+          width={40}
+        />
+      </InlineField>
       <InlineField label="MotherDuck Token" labelWidth={20} interactive tooltip={'MotherDuck Token'}>
         <SecretInput
           required
@@ -1,12 +1,27 @@
 import {  uniqBy } from 'lodash';
 // @ts-ignore
 import sqlFormatter from 'sql-formatter-plus';
-import { DataSourceInstanceSettings, ScopedVars, DataFrame, MetricFindValue, DataQueryRequest, TimeRange } from '@grafana/data';
+import {
+  DataSourceInstanceSettings,
+  ScopedVars,
+  DataFrame,
+  MetricFindValue,
+  DataQueryRequest,
+  DataQueryResponse,
+  DataSourceWithLogsContextSupport,
+  LogRowContextOptions,
+  LogRowContextQueryDirection,
+  LogRowModel,
+  TimeRange,
+  dateTime,
+} from '@grafana/data';
+import { lastValueFrom } from 'rxjs';
 import { TemplateSrv, HealthCheckError, HealthStatus } from '@grafana/runtime';
 import { Aggregate, DB, ResponseParser, SQLOptions, SQLQuery, SQLSelectableValue, SqlDatasource, SqlQueryModel, LanguageDefinition, QueryFormat } from '@grafana/plugin-ui';
 import { applyQueryDefaults } from './queryDefaults';
 import { VariableFormatID } from '@grafana/schema';
 import { getFieldConfig, toRawSql } from './sqlUtil';
+import { DuckDBQuery } from './types';
 
 import {
   ColumnDefinition,
@@ -28,6 +43,9 @@ interface MetricFindQueryOptions extends SearchFilterOptions {
 
 const SEARCH_FILTER_VARIABLE = '__searchFilter';
 
+// Log context queries look for the surrounding log lines within this window around the log line.
+const LOG_CONTEXT_WINDOW_MS = 24 * 60 * 60 * 1000;
+
 const containsSearchFilter = (query: string | unknown): boolean =>
   query && typeof query === 'string' ? query.indexOf(SEARCH_FILTER_VARIABLE) !== -1 : false;
 
@@ -175,22 +193,65 @@ async function functions(): Promise<Aggregate[]> {
 }
 
 
-export class DuckDBDataSource extends SqlDatasource {
+export class DuckDBDataSource extends SqlDatasource implements DataSourceWithLogsContextSupport<DuckDBQuery> {
   sqlLanguageDefinition: LanguageDefinition | undefined = undefined;
 
-  query(request: DataQueryRequest<SQLQuery>) {;
+  query(request: DataQueryRequest<DuckDBQuery>) {;
     const result = super.query(request);
     return result;
   }
 
-  applyTemplateVariables(target: SQLQuery, scopedVars: ScopedVars): SQLQuery {
+  applyTemplateVariables(target: DuckDBQuery, scopedVars: ScopedVars): DuckDBQuery {
     const queryModel = this.getQueryModel(target, this.templateSrv, scopedVars);
     return {
       refId: target.refId,
       datasource: this.getRef(),
       rawSql: queryModel.interpolate(),
       format: target.format,
+      incremental: target.incremental,
+      explain: target.explain,
+      logContext: target.logContext,
+      columns: target.columns,
+      labelColumns: target.labelColumns,
+      valueColumns: target.valueColumns,
+      legendFormat: target.legendFormat,
+      stream: target.stream,
+    };
+  }
+
+  // The backend narrows the query to the log lines before or after the given one.
+  async getLogRowContext(
+    row: LogRowModel,
+    options?: LogRowContextOptions,
+    query?: DuckDBQuery
+  ): Promise<DataQueryResponse> {
+    if (!query) {
+      return { data: [] };
+    }
+    const forward = options?.direction === LogRowContextQueryDirection.Forward;
+    const target: DuckDBQuery = {
+      ...query,
+      refId: `log-context-${query.refId}`,
+      logContext: {
+        time: row.timeEpochMs,
+        direction: forward ? 'forward' : 'backward',
+        limit: options?.limit,
+      },
     };
+    const from = dateTime(row.timeEpochMs - LOG_CONTEXT_WINDOW_MS);
+    const to = dateTime(row.timeEpochMs + LOG_CONTEXT_WINDOW_MS);
+    const request = {
+      targets: [target],
+      range: { from, to, raw: { from, to } },
+      app: 'explore',
+      interval: '1s',
+      intervalMs: 1000,
+      requestId: `log-context-${row.uid}`,
+      scopedVars: {},
+      startTime: Date.now(),
+      timezone: 'UTC',
+    } as DataQueryRequest<DuckDBQuery>;
+    return lastValueFrom(this.query(request));
   }
 
   async fetchTables(): Promise<string[]> {
@@ -1,4 +1,4 @@
-import { SQLOptions } from '@grafana/plugin-ui';
+import { SQLOptions, SQLQuery } from '@grafana/plugin-ui';
 
 
 // export interface DuckDBQuery extends SQLQuery {
@@ -19,12 +19,60 @@ import { SQLOptions } from '@grafana/plugin-ui';
 //   datapoints: DataPoint[];
 // }
 
+/**
+ * DuckDB specific options of a query, read by the backend next to the common SQL options
+ */
+export interface DuckDBQuery extends SQLQuery {
+  incremental?: boolean;
+  explain?: 'explain' | 'analyze';
+  logContext?: {
+    time: number;
+    direction: 'backward' | 'forward';
+    limit?: number;
+  };
+  columns?: Record<string, string>;
+  labelColumns?: string[];
+  valueColumns?: string[];
+  legendFormat?: string;
+  stream?: {
+    column?: string;
+    interval?: string;
+    files?: string;
+  };
+}
+
 /**
  * These are options configured for each DataSource instance
  */
 export interface DuckDBDataSourceOptions extends SQLOptions {
   path?: string;
   initSql?: string;
+  queryTimeout?: number;
+  profiling?: boolean;
+  readOnly?: boolean;
+  sandbox?: boolean;
+  allowedDirectories?: string[];
+  allowedStatements?: string[];
+  deniedStatements?: string[];
+  allowedTableFunctions?: string[];
+  deniedTableFunctions?: string[];
+  allowedFunctions?: string[];
+  deniedFunctions?: string[];
+  policyExemptRoles?: string[];
+  cacheTTL?: number;
+  cacheTimeStep?: number;
+  cacheMaxSize?: number;
+  maxConcurrentQueries?: number;
+  maxQueueLength?: number;
+  maxQueueWait?: number;
+  alertingWeight?: number;
+  dashboardWeight?: number;
+  memoryLimit?: string;
+  threads?: number;
+  tempDirectory?: string;
+  maxTempDirectorySize?: string;
+  memoryWatermark?: number;
+  streamCursorDirectory?: string;
 }
 
 /**